@@ -19,17 +19,22 @@
 package main
 
 import (
+	"context"
 	"encoding/csv"
 	"io"
 	"log"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/dvaumoron/casiusbot/common"
+	"github.com/dvaumoron/casiusbot/gdrive"
 )
 
 type memberActivity struct {
@@ -37,59 +42,191 @@ type memberActivity struct {
 	timestamp time.Time
 	vocal     bool
 }
+
+// with allResponse, all the recorded activities are returned (instead of the one of userId)
+type activityQuery struct {
+	userId      string
+	response    chan<- activityData
+	allResponse chan<- map[string]activityData
+}
 type activityData struct {
 	messageCount int
 	lastMessage  time.Time
 	lastVocal    time.Time
 }
 
-func bgManageActivity(session *discordgo.Session, saveTickReceiver <-chan bool, dataSender chan<- common.MultipartMessage, activityPath string, dateFormat string, cmdName string, infos common.GuildAndConfInfo) chan<- memberActivity {
+// activityModule record the last message and vocal activity of the members
+type activityModule struct {
+	baseModule
+	path         string
+	saveInterval time.Duration
+	saveChan     chan bool
+}
+
+func (m *activityModule) configure(b *bot) bool {
+	m.path = b.config.GetPath("ACTIVITY_FILE_PATH")
+	m.saveInterval = b.config.GetDurationSec("SAVE_ACTIVITY_INTERVAL")
+	if m.path == "" || m.saveInterval <= 0 {
+		return false
+	}
+
+	if b.cmdConfig["USER_ACTIVITIES"].Name != "" {
+		b.requireTarget(targetActivitiesChannel, "TARGET_ACTIVITIES_CHANNEL is required for activities")
+	}
+	return true
+}
+
+func (m *activityModule) register(b *bot) {
+	config := b.config
+	activityFileSender := b.channelManager.GetTarget(targetActivitiesChannel)
+	credentialsPath := config.GetPath("DRIVE_CREDENTIALS_PATH")
+	tokenPath := config.GetPath("DRIVE_TOKEN_PATH")
+	if credentialsPath != "" && tokenPath != "" {
+		driveFolderId := config.Require("DRIVE_FOLDER_ID")
+
+		var driveConfig gdrive.DriveConfig
+		stringParam := []*discordgo.ApplicationCommandOption{{
+			Type: discordgo.ApplicationCommandOptionString, Name: "code",
+			Description: config.Require("PARAMETER_DESCRIPTION_DRIVE_TOKEN_CMD"), Required: true,
+		}}
+		driveTokenName := b.addAdminCmd(helpGroupActivity, "DRIVE_TOKEN", stringParam, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			driveConfig.DriveTokenCmd(s, i, b.infosHolder.Get())
+		})
+		followLinkMsg := strings.ReplaceAll(config.Require("MESSAGE_FOLLOW_LINK"), common.CmdPlaceHolder, driveTokenName)
+
+		driveConfig = gdrive.ReadConfig(credentialsPath, tokenPath, followLinkMsg)
+
+		// wrap the channel sender (used for errors or refresh token links)
+		activityFileSender = driveConfig.CreateDriveSender(driveFolderId, activityFileSender)
+	}
+
+	m.saveChan = make(chan bool)
+	userActivitiesName := b.addAdminCmd(helpGroupActivity, "USER_ACTIVITIES", nil, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		infos := b.infosHolder.Get()
+		common.AuthorizedCmd(s, i, infos, func() string {
+			select {
+			case m.saveChan <- true:
+				return infos.Msgs.Ok
+			case <-b.ctx.Done():
+				return infos.Msgs.ErrGlobal
+			}
+		})
+	})
+
+	var activitySender chan<- memberActivity
+	activitySender, b.activityQuerier = bgManageActivity(b.ctx, &b.workers, b.loops.register("activity saver", m.saveInterval), b.session, m.saveChan, activityFileSender, m.path, b.dateFormat, userActivitiesName, &b.infosHolder)
+
+	b.session.AddHandler(func(s *discordgo.Session, u *discordgo.MessageCreate) {
+		if u.Member != nil {
+			sendActivity(b.ctx, activitySender, memberActivity{userId: u.Author.ID, timestamp: time.Now()})
+		}
+	})
+	b.session.AddHandler(func(s *discordgo.Session, u *discordgo.VoiceStateUpdate) {
+		if u.Member != nil {
+			sendActivity(b.ctx, activitySender, memberActivity{userId: u.UserID, timestamp: time.Now(), vocal: true})
+		}
+	})
+
+	activityQuerier := b.activityQuerier
+	whoisMsgs := makeWhoisMsgs(config)
+	b.addMenu(discordgo.UserApplicationCommand, b.menuConfig["SHOW_ACTIVITY"].WithDefaultPermission(b.adminPermission), func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		showActivityMenu(b.ctx, s, i, activityQuerier, whoisMsgs, b.dateFormat, b.infosHolder.Get())
+	})
+}
+
+func (m *activityModule) start(b *bot) {
+	go common.SendTick(b.ctx, m.saveChan, m.saveInterval)
+}
+
+// the activities are dropped after the final save
+func sendActivity(ctx context.Context, activitySender chan<- memberActivity, activity memberActivity) {
+	select {
+	case activitySender <- activity:
+	case <-ctx.Done():
+	}
+}
+
+// the activities are saved a last time when the context is done
+func bgManageActivity(ctx context.Context, workers *sync.WaitGroup, tick func(), session *discordgo.Session, saveTickReceiver <-chan bool, dataSender chan<- common.MultipartMessage, activityPath string, dateFormat string, cmdName string, infosHolder *common.InfosHolder) (chan<- memberActivity, chan<- activityQuery) {
 	activityChannel := make(chan memberActivity)
-	go manageActivity(session, saveTickReceiver, dataSender, activityPath, dateFormat, cmdName, infos, activityChannel)
-	return activityChannel
+	queryChannel := make(chan activityQuery)
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		manageActivity(ctx, tick, session, saveTickReceiver, dataSender, activityPath, dateFormat, cmdName, infosHolder, activityChannel, queryChannel)
+	}()
+	return activityChannel, queryChannel
 }
 
-func manageActivity(session *discordgo.Session, saveTickReceiver <-chan bool, dataSender chan<- common.MultipartMessage, activityPath string, dateFormat string, cmdName string, infos common.GuildAndConfInfo, activityChannelReceiver <-chan memberActivity) {
+func manageActivity(ctx context.Context, tick func(), session *discordgo.Session, saveTickReceiver <-chan bool, dataSender chan<- common.MultipartMessage, activityPath string, dateFormat string, cmdName string, infosHolder *common.InfosHolder, activityChannelReceiver <-chan memberActivity, queryReceiver <-chan activityQuery) {
 	activities := loadActivities(activityPath, dateFormat)
 	activityFileName := filepath.Base(activityPath)
-	errorMsg := strings.ReplaceAll(infos.Msgs.ErrGlobalCmd, common.CmdPlaceHolder, cmdName)
 	for {
 		select {
 		case mActivity := <-activityChannelReceiver:
 			activity := activities[mActivity.userId]
 			if mActivity.vocal {
 				activity.lastVocal = mActivity.timestamp
+				common.ActivityEvents.Inc("vocal")
 			} else {
+				common.ActivityEvents.Inc("message")
 				activity.messageCount++
 				activity.lastMessage = mActivity.timestamp
 			}
 			activities[mActivity.userId] = activity
-		case sendFile := <-saveTickReceiver:
-			var builder strings.Builder
-			writer := csv.NewWriter(&builder)
-			// header
-			writer.Write([]string{"userId", "userName", "userNickname", "messageCount", "lastMessage", "lastVocal", "lastActivity"})
-			for _, idNames := range loadMemberIdAndNames(session, infos) {
-				activity := activities[idNames[0]]
-
-				lastMessage := activity.lastMessage.Format(dateFormat)
-				lastVocal := activity.lastVocal.Format(dateFormat)
-				lastActivity := lastMessage
-				if activity.lastMessage.Before(activity.lastVocal) {
-					lastActivity = lastVocal
-				}
-
-				writer.Write([]string{idNames[0], idNames[1], idNames[2], strconv.Itoa(activity.messageCount), lastMessage, lastVocal, lastActivity})
+		case query := <-queryReceiver:
+			if query.allResponse != nil {
+				query.allResponse <- maps.Clone(activities)
+			} else {
+				query.response <- activities[query.userId]
 			}
-			writer.Flush()
-			data := builder.String()
-
+		case sendFile := <-saveTickReceiver:
+			tick()
+			infos := infosHolder.Get()
+			data := formatActivities(session, activities, dateFormat, infos)
 			if sendFile {
+				errorMsg := strings.ReplaceAll(infos.Msgs.ErrGlobalCmd, common.CmdPlaceHolder, cmdName)
 				dataSender <- common.MultipartMessage{FileName: activityFileName, FileData: data, ErrorMsg: errorMsg}
 			}
-			os.WriteFile(activityPath, []byte(data), 0o644)
+			if err := os.WriteFile(activityPath, []byte(data), 0o644); err != nil {
+				log.Println("Activity save failed :", err)
+			}
+		case <-ctx.Done():
+			if err := os.WriteFile(activityPath, []byte(formatActivities(session, activities, dateFormat, infosHolder.Get())), 0o644); err != nil {
+				log.Println("Final activity save failed :", err)
+			}
+			return
+		}
+	}
+}
+
+func formatActivities(session *discordgo.Session, activities map[string]activityData, dateFormat string, infos common.GuildAndConfInfo) string {
+	var builder strings.Builder
+	writer := csv.NewWriter(&builder)
+	// header
+	writer.Write([]string{"userId", "userName", "userNickname", "messageCount", "lastMessage", "lastVocal", "lastActivity"})
+	idAndNames := loadMemberIdAndNames(session, infos)
+	if idAndNames == nil {
+		// the members cannot be listed (as during shutdown), the saved activities are kept without names
+		idAndNames = make([][3]string, 0, len(activities))
+		for _, userId := range slices.Sorted(maps.Keys(activities)) {
+			idAndNames = append(idAndNames, [3]string{userId, "", ""})
 		}
 	}
+	for _, idNames := range idAndNames {
+		activity := activities[idNames[0]]
+
+		lastMessage := activity.lastMessage.Format(dateFormat)
+		lastVocal := activity.lastVocal.Format(dateFormat)
+		lastActivity := lastMessage
+		if activity.lastMessage.Before(activity.lastVocal) {
+			lastActivity = lastVocal
+		}
+
+		writer.Write([]string{idNames[0], idNames[1], idNames[2], strconv.Itoa(activity.messageCount), lastMessage, lastVocal, lastActivity})
+	}
+	writer.Flush()
+	return builder.String()
 }
 
 func loadActivities(activityPath string, dateFormat string) map[string]activityData {
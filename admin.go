@@ -0,0 +1,404 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"embed"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+	"golang.org/x/oauth2"
+)
+
+const (
+	adminSessionCookie   = "casiusbot_session"
+	adminStateCookie     = "casiusbot_state"
+	adminSessionDuration = 12 * time.Hour
+	adminStateDuration   = 5 * time.Minute
+	adminActionLimit     = 50
+)
+
+var discordEndpoint = oauth2.Endpoint{
+	AuthURL:  "https://discord.com/oauth2/authorize",
+	TokenURL: "https://discord.com/api/oauth2/token",
+}
+
+//go:embed templates/admin.html
+var adminTemplates embed.FS
+
+type adminSession struct {
+	userId     string
+	userName   string
+	csrfToken  string
+	expiration time.Time
+}
+
+// adminSessions keep the logged users in memory (a restart require a new login)
+type adminSessions struct {
+	idToSession map[string]adminSession
+	mutex       sync.Mutex
+}
+
+func (s *adminSessions) create(userId string, userName string) (string, adminSession) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for id, session := range s.idToSession {
+		if now.After(session.expiration) {
+			delete(s.idToSession, id)
+		}
+	}
+
+	id := rand.Text()
+	session := adminSession{userId: userId, userName: userName, csrfToken: rand.Text(), expiration: now.Add(adminSessionDuration)}
+	s.idToSession[id] = session
+	return id, session
+}
+
+func (s *adminSessions) get(id string) (adminSession, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session, ok := s.idToSession[id]
+	if ok && time.Now().After(session.expiration) {
+		delete(s.idToSession, id)
+		return adminSession{}, false
+	}
+	return session, ok
+}
+
+func (s *adminSessions) remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.idToSession, id)
+}
+
+type adminPageData struct {
+	UserName          string
+	CsrfToken         string
+	Result            string
+	PrefixRules       [][2]string
+	FeedsEnabled      bool
+	FeedsEditable     bool
+	Feeds             []feedConf
+	ChatEditable      bool
+	ChatRules         [][2]string
+	MessagesEditable  bool
+	Messages          [][2]string
+	ActivitiesEnabled bool
+	Activities        [][4]string
+	Actions           [][2]string
+}
+
+// adminModule serve a dashboard on /admin/ (with the HTTP server), the login use Discord OAuth2
+// and is restricted to the members with one of the AUTHORIZED_ROLES
+type adminModule struct {
+	baseModule
+	oauthConfig  *oauth2.Config
+	secureCookie bool
+	sessions     *adminSessions
+	page         *template.Template
+}
+
+func (m *adminModule) configure(b *bot) bool {
+	config := b.config
+	// public URL of the HTTP server (used for the OAuth2 redirection)
+	baseURL := strings.TrimSuffix(config.GetString("ADMIN_URL"), "/")
+	if baseURL == "" {
+		return false
+	}
+	if b.mux == nil {
+		b.problems = append(b.problems, "HTTP_ADDRESS is required for the admin dashboard")
+		return false
+	}
+
+	m.oauthConfig = &oauth2.Config{
+		ClientID: config.Require("ADMIN_CLIENT_ID"), ClientSecret: config.Require("ADMIN_CLIENT_SECRET"),
+		Endpoint: discordEndpoint, RedirectURL: baseURL + "/admin/callback", Scopes: []string{"identify"},
+	}
+	m.secureCookie = strings.HasPrefix(baseURL, "https://")
+	m.sessions = &adminSessions{idToSession: map[string]adminSession{}}
+	m.page = template.Must(template.ParseFS(adminTemplates, "templates/admin.html"))
+	return true
+}
+
+func (m *adminModule) register(b *bot) {
+	b.mux.HandleFunc("GET /admin/{$}", func(w http.ResponseWriter, r *http.Request) {
+		if _, session, ok := m.authenticate(b, w, r, false); ok {
+			m.dashboard(b, w, r, session)
+		}
+	})
+	b.mux.HandleFunc("GET /admin/login", m.login)
+	b.mux.HandleFunc("GET /admin/callback", func(w http.ResponseWriter, r *http.Request) {
+		m.callback(b, w, r)
+	})
+	b.mux.HandleFunc("POST /admin/logout", func(w http.ResponseWriter, r *http.Request) {
+		if sessionId, _, ok := m.authenticate(b, w, r, true); ok {
+			m.sessions.remove(sessionId)
+			m.setCookie(w, adminSessionCookie, "", -1)
+			http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+		}
+	})
+
+	b.mux.HandleFunc("POST /admin/chat", func(w http.ResponseWriter, r *http.Request) {
+		m.change(b, w, r, func(session adminSession) bool {
+			keyword := strings.TrimSpace(r.PostFormValue("keyword"))
+			if keyword == "" || b.chat.path == "" {
+				return false
+			}
+			log.Println("Admin dashboard :", session.userName, "set the chat rule", keyword)
+			return b.chat.register(keyword, r.PostFormValue("response"))
+		})
+	})
+	b.mux.HandleFunc("POST /admin/feeds", func(w http.ResponseWriter, r *http.Request) {
+		m.change(b, w, r, func(session adminSession) bool {
+			feedURL := strings.TrimSpace(r.PostFormValue("url"))
+			if b.feeds == nil || !validFeedURL(feedURL) {
+				return false
+			}
+			if r.PostFormValue("action") == "remove" {
+				log.Println("Admin dashboard :", session.userName, "remove the feed", feedURL)
+				return b.feeds.remove(feedURL)
+			}
+			log.Println("Admin dashboard :", session.userName, "set the feed", feedURL)
+			return b.feeds.set(feedConf{
+				URL: feedURL, TranslateSelector: strings.TrimSpace(r.PostFormValue("selector")),
+				Checker: strings.TrimSpace(r.PostFormValue("checker")),
+			})
+		})
+	})
+	b.mux.HandleFunc("POST /admin/messages", func(w http.ResponseWriter, r *http.Request) {
+		m.change(b, w, r, func(session adminSession) bool {
+			key := r.PostFormValue("key")
+			log.Println("Admin dashboard :", session.userName, "set the message", key)
+			ok := b.messages.set(key, r.PostFormValue("message"))
+			// the infos are rebuilt even after a failed save (the change is applied)
+			b.confUpdater.updateMessages(b.session, b.messages.messages())
+			return ok
+		})
+	})
+}
+
+func (m *adminModule) setCookie(w http.ResponseWriter, name string, value string, maxAge time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name: name, Value: value, Path: "/admin/", MaxAge: int(maxAge.Seconds()),
+		HttpOnly: true, Secure: m.secureCookie, SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// redirect to the login page without valid session and reject the members without one of the AUTHORIZED_ROLES,
+// the roles are checked at each request (they could have been removed since the login)
+func (m *adminModule) authenticate(b *bot, w http.ResponseWriter, r *http.Request, checkCsrf bool) (string, adminSession, bool) {
+	cookie, err := r.Cookie(adminSessionCookie)
+	if err != nil {
+		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+		return "", adminSession{}, false
+	}
+
+	sessionId := cookie.Value
+	session, ok := m.sessions.get(sessionId)
+	if !ok {
+		http.Redirect(w, r, "/admin/login", http.StatusSeeOther)
+		return "", adminSession{}, false
+	}
+	if !authorizedAdmin(b, session.userId) {
+		m.sessions.remove(sessionId)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", adminSession{}, false
+	}
+	if checkCsrf && subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(session.csrfToken)) != 1 {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", adminSession{}, false
+	}
+	return sessionId, session, true
+}
+
+func authorizedAdmin(b *bot, userId string) bool {
+	infos := b.infosHolder.Get()
+	member, err := b.session.State.Member(infos.GuildId, userId)
+	if err != nil {
+		if member, err = b.session.GuildMember(infos.GuildId, userId); err != nil {
+			log.Println("Cannot retrieve the member (admin) :", err)
+			return false
+		}
+	}
+	return common.IdInSet(member.Roles, infos.AuthorizedRoleIds)
+}
+
+func (m *adminModule) login(w http.ResponseWriter, r *http.Request) {
+	state := rand.Text()
+	m.setCookie(w, adminStateCookie, state, adminStateDuration)
+	http.Redirect(w, r, m.oauthConfig.AuthCodeURL(state), http.StatusSeeOther)
+}
+
+func (m *adminModule) callback(b *bot, w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(adminStateCookie)
+	if err != nil || cookie.Value == "" || cookie.Value != r.FormValue("state") {
+		http.Error(w, "Invalid state", http.StatusBadRequest)
+		return
+	}
+	m.setCookie(w, adminStateCookie, "", -1)
+
+	token, err := m.oauthConfig.Exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		log.Println("OAuth2 code exchange failed :", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	userSession, err := discordgo.New("Bearer " + token.AccessToken)
+	if err != nil {
+		log.Println("Cannot create the user session :", err)
+		http.Error(w, "Login failed", http.StatusInternalServerError)
+		return
+	}
+	user, err := userSession.User("@me")
+	if err != nil {
+		log.Println("Cannot retrieve the logged user :", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	if !authorizedAdmin(b, user.ID) {
+		log.Println("Admin dashboard : unauthorized login of", user.Username)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	sessionId, _ := m.sessions.create(user.ID, user.Username)
+	m.setCookie(w, adminSessionCookie, sessionId, adminSessionDuration)
+	http.Redirect(w, r, "/admin/", http.StatusSeeOther)
+}
+
+// apply a change from a form, then redirect to the dashboard with the result
+func (m *adminModule) change(b *bot, w http.ResponseWriter, r *http.Request, apply func(adminSession) bool) {
+	if _, session, ok := m.authenticate(b, w, r, true); ok {
+		result := "failed"
+		if apply(session) {
+			result = "ok"
+		}
+		http.Redirect(w, r, "/admin/?result="+result, http.StatusSeeOther)
+	}
+}
+
+func validFeedURL(feedURL string) bool {
+	parsed, err := url.Parse(feedURL)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+func (m *adminModule) dashboard(b *bot, w http.ResponseWriter, r *http.Request, session adminSession) {
+	infos := b.infosHolder.Get()
+	data := adminPageData{
+		UserName: session.userName, CsrfToken: session.csrfToken, Result: r.FormValue("result"),
+		ChatEditable: b.chat.path != "", ChatRules: b.chat.list(),
+		MessagesEditable: b.messages.editable(), Messages: b.messages.list(),
+		Actions: recentBotActions(b.session, b.dateFormat, infos.GuildId),
+	}
+
+	for roleId, prefix := range infos.RoleIdToPrefix {
+		data.PrefixRules = append(data.PrefixRules, [2]string{infos.RoleIdToDisplayName[roleId], prefix})
+	}
+	slices.SortFunc(data.PrefixRules, func(a [2]string, b [2]string) int {
+		return cmp.Compare(a[0], b[0])
+	})
+
+	if b.feeds != nil {
+		data.FeedsEnabled, data.FeedsEditable, data.Feeds = true, b.feeds.editable(), b.feeds.list()
+	}
+
+	if b.activityQuerier != nil {
+		if activities, ok := queryAllActivities(r.Context(), b.ctx, b.activityQuerier); ok {
+			data.ActivitiesEnabled = true
+			data.Activities = formatActivityRows(b.session, activities, b.dateFormat, infos)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := m.page.ExecuteTemplate(w, "admin.html", data); err != nil {
+		log.Println("Admin dashboard rendering failed :", err)
+	}
+}
+
+// ok is false when the request or the bot is ended before the response
+func queryAllActivities(requestCtx context.Context, botCtx context.Context, activityQuerier chan<- activityQuery) (map[string]activityData, bool) {
+	response := make(chan map[string]activityData, 1)
+	select {
+	case activityQuerier <- activityQuery{allResponse: response}:
+		return <-response, true
+	case <-requestCtx.Done():
+	case <-botCtx.Done():
+	}
+	return nil, false
+}
+
+// a row by member (name, message count, last message and last vocal), the zero dates are left empty
+func formatActivityRows(session *discordgo.Session, activities map[string]activityData, dateFormat string, infos common.GuildAndConfInfo) [][4]string {
+	idAndNames := loadMemberIdAndNames(session, infos)
+	rows := make([][4]string, 0, len(idAndNames))
+	for _, idNames := range idAndNames {
+		activity := activities[idNames[0]]
+		name := idNames[2]
+		if name == "" {
+			name = idNames[1]
+		}
+		rows = append(rows, [4]string{name, strconv.Itoa(activity.messageCount), formatNonZero(activity.lastMessage, dateFormat), formatNonZero(activity.lastVocal, dateFormat)})
+	}
+	return rows
+}
+
+func formatNonZero(date time.Time, dateFormat string) string {
+	if date.IsZero() {
+		return ""
+	}
+	return date.Format(dateFormat)
+}
+
+// read the last actions of the bot from the guild audit log, with the target member name
+func recentBotActions(s *discordgo.Session, dateFormat string, guildId string) [][2]string {
+	auditLog, err := s.GuildAuditLog(guildId, s.State.User.ID, "", 0, adminActionLimit)
+	if err != nil {
+		log.Println("Cannot retrieve the audit log (3) :", err)
+		return nil
+	}
+
+	idToName := make(map[string]string, len(auditLog.Users))
+	for _, user := range auditLog.Users {
+		idToName[user.ID] = user.Username
+	}
+
+	actions := make([][2]string, 0, len(auditLog.AuditLogEntries))
+	for _, entry := range auditLog.AuditLogEntries {
+		actions = append(actions, [2]string{cmp.Or(idToName[entry.TargetID], entry.TargetID), formatBotAction(entry, dateFormat)})
+	}
+	return actions
+}
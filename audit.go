@@ -0,0 +1,237 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+const (
+	auditJoin  = "join"
+	auditLeave = "leave"
+	auditNick  = "nick"
+	auditRoles = "roles"
+
+	authorPlaceHolder = "{{author}}"
+	rolesPlaceHolder  = "{{roles}}"
+
+	// audit log entries older than that are not considered as the origin of a change
+	auditLogMaxAge = 30 * time.Second
+
+	colorJoin  = 0x57F287
+	colorLeave = 0xED4245
+	colorNick  = 0x5865F2
+	colorRoles = 0xFEE75C
+
+	auditQueueSize = 32
+)
+
+type auditModule struct {
+	baseModule
+}
+
+func (auditModule) configure(b *bot) bool {
+	return b.targetToRef[targetAuditChannel] != ""
+}
+
+func (auditModule) register(b *bot) {
+	audit := makeAuditor(b.config, b.channelManager, &b.infosHolder)
+	// a single worker keep the order of the events in the audit channel
+	auditSender := bgAudit(b.ctx)
+	b.onMemberUpdate(func(s *discordgo.Session, previous memberState, seen bool, member *discordgo.Member) bool {
+		sendAudit(b.ctx, auditSender, func() {
+			audit.update(s, previous, seen, member)
+		})
+		return false
+	})
+	b.onMemberAdd(func(s *discordgo.Session, member *discordgo.Member) {
+		sendAudit(b.ctx, auditSender, func() {
+			audit.join(member)
+		})
+	})
+	b.onMemberRemove(func(s *discordgo.Session, user *discordgo.User, state memberState, seen bool) {
+		sendAudit(b.ctx, auditSender, func() {
+			audit.leave(user)
+		})
+	})
+}
+
+func bgAudit(ctx context.Context) chan<- func() {
+	auditChannel := make(chan func(), auditQueueSize)
+	go manageAudit(ctx, auditChannel)
+	return auditChannel
+}
+
+func manageAudit(ctx context.Context, auditReceiver <-chan func()) {
+	for {
+		select {
+		case task := <-auditReceiver:
+			task()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// the events are dropped after the shutdown
+func sendAudit(ctx context.Context, auditSender chan<- func(), task func()) {
+	select {
+	case auditSender <- task:
+	case <-ctx.Done():
+	}
+}
+
+// auditor post the member changes (seen on gateway events) as embeds in the audit channel
+type auditor struct {
+	manager     common.ChannelSenderManager
+	infosHolder *common.InfosHolder
+	events      common.StringSet
+	joinMsg     string
+	leaveMsg    string
+	nickMsg     string
+	rolesMsg    string
+	unknownMsg  string
+}
+
+func makeAuditor(config common.Config, manager common.ChannelSenderManager, infosHolder *common.InfosHolder) *auditor {
+	events := common.StringSet{}
+	for _, event := range config.GetStringSlice("AUDIT_EVENTS") {
+		switch event {
+		case auditJoin, auditLeave, auditNick, auditRoles:
+			events[event] = common.Empty{}
+		default:
+			panic("AUDIT_EVENTS must contain only : \"join\", \"leave\", \"nick\", \"roles\"")
+		}
+	}
+	if len(events) == 0 {
+		// all events by default
+		events = common.StringSet{auditJoin: {}, auditLeave: {}, auditNick: {}, auditRoles: {}}
+	}
+
+	return &auditor{
+		manager: manager, infosHolder: infosHolder, events: events,
+		joinMsg: config.GetString("MESSAGE_AUDIT_JOIN"), leaveMsg: config.GetString("MESSAGE_AUDIT_LEAVE"),
+		nickMsg: config.GetString("MESSAGE_AUDIT_NICK"), rolesMsg: config.GetString("MESSAGE_AUDIT_ROLES"),
+		unknownMsg: config.GetString("MESSAGE_AUDIT_UNKNOWN_AUTHOR"),
+	}
+}
+
+func (a *auditor) enabled(event string) bool {
+	_, ok := a.events[event]
+	return ok
+}
+
+func (a *auditor) join(member *discordgo.Member) {
+	if a.enabled(auditJoin) {
+		a.send(colorJoin, strings.ReplaceAll(a.joinMsg, common.UserPlaceHolder, describeUser(member.User)))
+	}
+}
+
+func (a *auditor) leave(user *discordgo.User) {
+	if a.enabled(auditLeave) {
+		a.send(colorLeave, strings.ReplaceAll(a.leaveMsg, common.UserPlaceHolder, describeUser(user)))
+	}
+}
+
+// compare the member with its previous state (nothing is sent when the member was not seen)
+func (a *auditor) update(s *discordgo.Session, previous memberState, seen bool, member *discordgo.Member) {
+	if !seen {
+		return
+	}
+
+	infos := a.infosHolder.Get()
+	userDesc := describeUser(member.User)
+	if nick := common.ExtractNick(member); a.enabled(auditNick) && nick != previous.nick {
+		msg := strings.ReplaceAll(a.nickMsg, common.UserPlaceHolder, userDesc)
+		msg = strings.ReplaceAll(msg, "{{old}}", previous.nick)
+		msg = strings.ReplaceAll(msg, "{{new}}", nick)
+		msg = strings.ReplaceAll(msg, authorPlaceHolder, a.findAuthor(s, infos.GuildId, member.User.ID, discordgo.AuditLogActionMemberUpdate))
+		a.send(colorNick, msg)
+	}
+
+	if !a.enabled(auditRoles) {
+		return
+	}
+
+	var buffer strings.Builder
+	for _, roleId := range member.Roles {
+		if !slices.Contains(previous.roleIds, roleId) {
+			buffer.WriteString(" +")
+			buffer.WriteString(roleName(roleId, infos))
+		}
+	}
+	for _, roleId := range previous.roleIds {
+		if !slices.Contains(member.Roles, roleId) {
+			buffer.WriteString(" -")
+			buffer.WriteString(roleName(roleId, infos))
+		}
+	}
+	if buffer.Len() != 0 {
+		msg := strings.ReplaceAll(a.rolesMsg, common.UserPlaceHolder, userDesc)
+		msg = strings.ReplaceAll(msg, rolesPlaceHolder, strings.TrimSpace(buffer.String()))
+		msg = strings.ReplaceAll(msg, authorPlaceHolder, a.findAuthor(s, infos.GuildId, member.User.ID, discordgo.AuditLogActionMemberRoleUpdate))
+		a.send(colorRoles, msg)
+	}
+}
+
+// search in the guild audit log who made the last change on the member
+func (a *auditor) findAuthor(s *discordgo.Session, guildId string, userId string, action discordgo.AuditLogAction) string {
+	auditLog, err := s.GuildAuditLog(guildId, "", "", int(action), 10)
+	if err != nil {
+		log.Println("Cannot retrieve the audit log :", err)
+		return a.unknownMsg
+	}
+
+	limit := time.Now().Add(-auditLogMaxAge)
+	for _, entry := range auditLog.AuditLogEntries {
+		if entry.TargetID != userId {
+			continue
+		}
+		// entries are sorted from the most recent
+		if date, err := discordgo.SnowflakeTimestamp(entry.ID); err != nil || date.Before(limit) {
+			break
+		}
+		for _, user := range auditLog.Users {
+			if user.ID == entry.UserID {
+				return describeUser(user)
+			}
+		}
+		return "<@" + entry.UserID + ">"
+	}
+	return a.unknownMsg
+}
+
+func (a *auditor) send(color int, msg string) {
+	if auditSender := a.manager.GetTarget(targetAuditChannel); auditSender != nil {
+		auditSender <- common.MultipartMessage{Embeds: []*discordgo.MessageEmbed{{
+			Description: msg, Color: color, Timestamp: time.Now().Format(time.RFC3339),
+		}}}
+	}
+}
+
+func describeUser(user *discordgo.User) string {
+	return user.Mention() + " (" + user.Username + ")"
+}
@@ -0,0 +1,239 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+const (
+	captchaAnswerButtonId = "casiusbot-captcha-answer"
+	captchaModalId        = "casiusbot-captcha-modal"
+	captchaInputId        = "casiusbot-captcha-input"
+	captchaFileName       = "captcha.png"
+	captchaLength         = 6
+	captchaMaxAttempts    = 3
+)
+
+type pendingCaptcha struct {
+	answer   string
+	expireAt time.Time
+	attempts int
+}
+
+// captchaChecker send a captcha image by private message, the answer is typed in a modal
+type captchaChecker struct {
+	msg         string
+	sentMsg     string
+	wrongMsg    string
+	failedMsg   string
+	expiredMsg  string
+	buttonLabel string
+	inputLabel  string
+	delay       time.Duration
+	kick        bool
+	idToCaptcha map[string]pendingCaptcha
+	failedIds   common.StringSet // members with too many wrong answers (until they leave)
+	mutex       sync.Mutex
+}
+
+func makeCaptchaChecker(config common.Config) *captchaChecker {
+	delay := config.GetDurationSec("CAPTCHA_DELAY")
+	if delay <= 0 {
+		panic("CAPTCHA_DELAY is required with CAPTCHA")
+	}
+
+	return &captchaChecker{
+		msg: config.GetString("MESSAGE_CAPTCHA"), sentMsg: config.GetString("MESSAGE_CAPTCHA_SENT"),
+		wrongMsg: config.GetString("MESSAGE_CAPTCHA_WRONG"), failedMsg: config.GetString("MESSAGE_CAPTCHA_FAILED"),
+		expiredMsg: config.GetString("MESSAGE_CAPTCHA_EXPIRED"), buttonLabel: config.Require("LABEL_CAPTCHA_BUTTON"),
+		inputLabel: config.Require("LABEL_CAPTCHA_INPUT"), delay: delay, kick: config.GetBool("CAPTCHA_KICK"),
+		idToCaptcha: map[string]pendingCaptcha{}, failedIds: common.StringSet{},
+	}
+}
+
+// generate a new captcha and send it to the member (the previous one is replaced), return the message for the interaction response
+// (a member who failed is refused a new captcha)
+func (c *captchaChecker) challenge(s *discordgo.Session, userId string, infos common.GuildAndConfInfo) string {
+	c.mutex.Lock()
+	_, failed := c.failedIds[userId]
+	c.mutex.Unlock()
+	if failed {
+		return c.failedMsg
+	}
+
+	answer, imageData, err := common.GenerateCaptcha(captchaLength)
+	if err != nil {
+		log.Println("Captcha generation failed :", err)
+		return infos.Msgs.ErrGlobal
+	}
+
+	channel, err := s.UserChannelCreate(userId)
+	if err != nil {
+		log.Println("Cannot create the private channel :", err)
+		return infos.Msgs.ErrGlobal
+	}
+
+	c.mutex.Lock()
+	// a new image keep the attempts and the deadline of the pending captcha
+	pending, ok := c.idToCaptcha[userId]
+	if !ok {
+		pending.expireAt = time.Now().Add(c.delay)
+	}
+	pending.answer = answer
+	c.idToCaptcha[userId] = pending
+	c.mutex.Unlock()
+
+	common.SendMultipartMessage(s, channel.ID, common.MultipartMessage{
+		Message: c.msg, FileName: captchaFileName, FileData: string(imageData),
+		Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+			discordgo.Button{Label: c.buttonLabel, Style: discordgo.PrimaryButton, CustomID: captchaAnswerButtonId},
+		}}},
+	})
+	return c.sentMsg
+}
+
+// open the modal to type the answer
+func (c *captchaChecker) answerButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	c.mutex.Lock()
+	_, ok := c.idToCaptcha[interactionUserId(i)]
+	c.mutex.Unlock()
+	if !ok {
+		respondEphemeral(s, i, c.expiredMsg)
+		return
+	}
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: captchaModalId, Title: c.inputLabel,
+			Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.TextInput{
+					CustomID: captchaInputId, Label: c.inputLabel, Style: discordgo.TextInputShort,
+					Required: true, MinLength: captchaLength, MaxLength: captchaLength,
+				},
+			}}},
+		},
+	})
+}
+
+// check the answer, return true when it is correct and the message for the interaction response
+func (c *captchaChecker) check(s *discordgo.Session, i *discordgo.InteractionCreate, infos common.GuildAndConfInfo) (bool, string) {
+	userId := interactionUserId(i)
+	answer := strings.TrimSpace(readModalInput(i.ModalSubmitData(), captchaInputId))
+
+	c.mutex.Lock()
+	pending, ok := c.idToCaptcha[userId]
+	if !ok {
+		c.mutex.Unlock()
+		return false, c.expiredMsg
+	}
+	if time.Now().After(pending.expireAt) {
+		delete(c.idToCaptcha, userId)
+		c.mutex.Unlock()
+		c.fail(s, userId, "expired", infos)
+		return false, c.expiredMsg
+	}
+	if strings.EqualFold(answer, pending.answer) {
+		delete(c.idToCaptcha, userId)
+		c.mutex.Unlock()
+		return true, ""
+	}
+
+	pending.attempts++
+	if pending.attempts < captchaMaxAttempts {
+		c.idToCaptcha[userId] = pending
+		c.mutex.Unlock()
+		log.Println("Wrong captcha answer for user", userId)
+		return false, c.wrongMsg
+	}
+	delete(c.idToCaptcha, userId)
+	c.failedIds[userId] = common.Empty{}
+	c.mutex.Unlock()
+	c.fail(s, userId, "failed", infos)
+	return false, c.failedMsg
+}
+
+// handle the captchas without answer in time
+func (c *captchaChecker) expire(s *discordgo.Session, infos common.GuildAndConfInfo) {
+	now := time.Now()
+	var expiredIds []string
+	c.mutex.Lock()
+	for userId, pending := range c.idToCaptcha {
+		if now.After(pending.expireAt) {
+			expiredIds = append(expiredIds, userId)
+			delete(c.idToCaptcha, userId)
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, userId := range expiredIds {
+		c.fail(s, userId, "expired", infos)
+	}
+}
+
+func (c *captchaChecker) fail(s *discordgo.Session, userId string, reason string, infos common.GuildAndConfInfo) {
+	log.Println("Captcha", reason, "for user", userId)
+	if c.kick {
+		if err := s.GuildMemberDeleteWithReason(infos.GuildId, userId, "captcha "+reason); err != nil {
+			log.Println("Captcha kick failed :", err)
+		}
+	}
+}
+
+func (c *captchaChecker) forget(userId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.idToCaptcha, userId)
+	delete(c.failedIds, userId)
+}
+
+// in a private channel, Member is nil
+func interactionUserId(i *discordgo.InteractionCreate) string {
+	if i.Member != nil {
+		return i.Member.User.ID
+	}
+	return i.User.ID
+}
+
+func readModalInput(data discordgo.ModalSubmitInteractionData, inputId string) string {
+	for _, component := range data.Components {
+		if row, ok := component.(*discordgo.ActionsRow); ok {
+			for _, rowComponent := range row.Components {
+				if input, ok := rowComponent.(*discordgo.TextInput); ok && input.CustomID == inputId {
+					return input.Value
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, msg string) {
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Content: msg, Flags: discordgo.MessageFlagsEphemeral},
+	})
+}
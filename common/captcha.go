@@ -0,0 +1,171 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand/v2"
+)
+
+const (
+	glyphWidth    = 5
+	glyphHeight   = 7
+	captchaScale  = 6
+	captchaMargin = 12
+	captchaNoise  = 8
+)
+
+// alphabet without the easily confused characters (0, O, 1, I)
+const captchaAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// 5x7 bitmap font, each row use the 5 lowest bits
+var captchaFont = map[byte][glyphHeight]uint8{
+	'A': {0b01110, 0b10001, 0b10001, 0b11111, 0b10001, 0b10001, 0b10001},
+	'B': {0b11110, 0b10001, 0b10001, 0b11110, 0b10001, 0b10001, 0b11110},
+	'C': {0b01110, 0b10001, 0b10000, 0b10000, 0b10000, 0b10001, 0b01110},
+	'D': {0b11110, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b11110},
+	'E': {0b11111, 0b10000, 0b10000, 0b11110, 0b10000, 0b10000, 0b11111},
+	'F': {0b11111, 0b10000, 0b10000, 0b11110, 0b10000, 0b10000, 0b10000},
+	'G': {0b01110, 0b10001, 0b10000, 0b10111, 0b10001, 0b10001, 0b01111},
+	'H': {0b10001, 0b10001, 0b10001, 0b11111, 0b10001, 0b10001, 0b10001},
+	'J': {0b00111, 0b00010, 0b00010, 0b00010, 0b00010, 0b10010, 0b01100},
+	'K': {0b10001, 0b10010, 0b10100, 0b11000, 0b10100, 0b10010, 0b10001},
+	'L': {0b10000, 0b10000, 0b10000, 0b10000, 0b10000, 0b10000, 0b11111},
+	'M': {0b10001, 0b11011, 0b10101, 0b10101, 0b10001, 0b10001, 0b10001},
+	'N': {0b10001, 0b10001, 0b11001, 0b10101, 0b10011, 0b10001, 0b10001},
+	'P': {0b11110, 0b10001, 0b10001, 0b11110, 0b10000, 0b10000, 0b10000},
+	'Q': {0b01110, 0b10001, 0b10001, 0b10001, 0b10101, 0b10010, 0b01101},
+	'R': {0b11110, 0b10001, 0b10001, 0b11110, 0b10100, 0b10010, 0b10001},
+	'S': {0b01111, 0b10000, 0b10000, 0b01110, 0b00001, 0b00001, 0b11110},
+	'T': {0b11111, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100, 0b00100},
+	'U': {0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01110},
+	'V': {0b10001, 0b10001, 0b10001, 0b10001, 0b10001, 0b01010, 0b00100},
+	'W': {0b10001, 0b10001, 0b10001, 0b10101, 0b10101, 0b10101, 0b01010},
+	'X': {0b10001, 0b10001, 0b01010, 0b00100, 0b01010, 0b10001, 0b10001},
+	'Y': {0b10001, 0b10001, 0b01010, 0b00100, 0b00100, 0b00100, 0b00100},
+	'Z': {0b11111, 0b00001, 0b00010, 0b00100, 0b01000, 0b10000, 0b11111},
+	'2': {0b01110, 0b10001, 0b00001, 0b00010, 0b00100, 0b01000, 0b11111},
+	'3': {0b11111, 0b00010, 0b00100, 0b00010, 0b00001, 0b10001, 0b01110},
+	'4': {0b00010, 0b00110, 0b01010, 0b10010, 0b11111, 0b00010, 0b00010},
+	'5': {0b11111, 0b10000, 0b11110, 0b00001, 0b00001, 0b10001, 0b01110},
+	'6': {0b00110, 0b01000, 0b10000, 0b11110, 0b10001, 0b10001, 0b01110},
+	'7': {0b11111, 0b00001, 0b00010, 0b00100, 0b01000, 0b01000, 0b01000},
+	'8': {0b01110, 0b10001, 0b10001, 0b01110, 0b10001, 0b10001, 0b01110},
+	'9': {0b01110, 0b10001, 0b10001, 0b01111, 0b00001, 0b00010, 0b01100},
+}
+
+// return a random text and its rendering as a PNG image (with jitter and noise lines)
+func GenerateCaptcha(length int) (string, []byte, error) {
+	text := make([]byte, length)
+	for index := range text {
+		text[index] = captchaAlphabet[rand.IntN(len(captchaAlphabet))]
+	}
+
+	glyphStep := (glyphWidth + 2) * captchaScale
+	width := 2*captchaMargin + length*glyphStep
+	height := 2*captchaMargin + (glyphHeight+2)*captchaScale
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	background := color.RGBA{R: 240, G: 240, B: 230, A: 255}
+	for y := range height {
+		for x := range width {
+			img.SetRGBA(x, y, background)
+		}
+	}
+
+	for index, char := range text {
+		ink := randomDarkColor()
+		originX := captchaMargin + index*glyphStep + rand.IntN(captchaScale)
+		originY := captchaMargin + rand.IntN(2*captchaScale)
+		// each glyph is slanted differently
+		shear := rand.IntN(3) - 1
+		for row, bits := range captchaFont[char] {
+			rowShift := shear * (glyphHeight/2 - row)
+			for col := range glyphWidth {
+				if bits&(1<<(glyphWidth-1-col)) != 0 {
+					fillRect(img, originX+col*captchaScale+rowShift, originY+row*captchaScale, captchaScale, captchaScale, ink)
+				}
+			}
+		}
+	}
+
+	for range captchaNoise {
+		drawLine(img, rand.IntN(width), rand.IntN(height), rand.IntN(width), rand.IntN(height), randomDarkColor())
+	}
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		return "", nil, err
+	}
+	return string(text), buffer.Bytes(), nil
+}
+
+func randomDarkColor() color.RGBA {
+	return color.RGBA{R: uint8(rand.IntN(120)), G: uint8(rand.IntN(120)), B: uint8(rand.IntN(120)), A: 255}
+}
+
+func fillRect(img *image.RGBA, x int, y int, width int, height int, c color.RGBA) {
+	for dy := range height {
+		for dx := range width {
+			img.SetRGBA(x+dx, y+dy, c)
+		}
+	}
+}
+
+// Bresenham algorithm
+func drawLine(img *image.RGBA, x0 int, y0 int, x1 int, y1 int, c color.RGBA) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+
+	err := dx + dy
+	for {
+		img.SetRGBA(x0, y0, c)
+		img.SetRGBA(x0, y0+1, c)
+		e2 := 2 * err
+		if e2 >= dy {
+			if x0 == x1 {
+				return
+			}
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			if y0 == y1 {
+				return
+			}
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+	return value
+}
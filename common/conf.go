@@ -27,6 +27,7 @@ import (
 	"path"
 	"time"
 
+	"github.com/bwmarrin/discordgo"
 	"gopkg.in/natefinch/lumberjack.v2"
 	"gopkg.in/yaml.v3"
 )
@@ -38,10 +39,42 @@ const (
 
 type CmdRoleDesc struct {
 	Cmd   string
-	Name  string
+	Name  string // could be a role name or id
 	Group string
 }
 
+// when there is roles or users, they replace AUTHORIZED_ROLES for the command (only for admin commands)
+type CmdConf struct {
+	Name        string
+	Description string
+	Roles       []string // could be role names or ids
+	Users       []string
+	Ephemeral   bool // the response is only visible by the member who used the command
+	// nil when the command is visible to everyone
+	Permission *int64
+	everyone   bool
+}
+
+// return the CmdConf with the permission set when there is not one configured
+// (nor roles or users, the members listed could lack the permission)
+func (c CmdConf) WithDefaultPermission(permission *int64) CmdConf {
+	if c.Permission == nil && !c.everyone && len(c.Roles) == 0 && len(c.Users) == 0 {
+		c.Permission = permission
+	}
+	return c
+}
+
+var nameToPermission = map[string]int64{
+	"ADMINISTRATOR":    discordgo.PermissionAdministrator,
+	"MANAGE_GUILD":     discordgo.PermissionManageServer,
+	"MANAGE_ROLES":     discordgo.PermissionManageRoles,
+	"MANAGE_NICKNAMES": discordgo.PermissionManageNicknames,
+	"MANAGE_MESSAGES":  discordgo.PermissionManageMessages,
+	"MODERATE_MEMBERS": discordgo.PermissionModerateMembers,
+	"KICK_MEMBERS":     discordgo.PermissionKickMembers,
+	"BAN_MEMBERS":      discordgo.PermissionBanMembers,
+}
+
 type Config struct {
 	basePath string
 	data     map[string]any
@@ -109,6 +142,7 @@ func (c Config) GetPrefixConfig() (map[string]string, []string, []CmdRoleDesc, [
 		panic("Malformed PREFIX_RULES")
 	}
 
+	// role could be referenced by name or id
 	nameToPrefix := map[string]string{}
 	prefixes := []string{}
 	specialRoleNames := []string{}
@@ -145,13 +179,25 @@ func (c Config) GetPrefixConfig() (map[string]string, []string, []CmdRoleDesc, [
 	return nameToPrefix, prefixes, cmdRoleDescs, specialRoleNames
 }
 
-func (c Config) GetCommandConfig() map[string][2]string {
+func (c Config) GetCommandConfig() map[string]CmdConf {
 	cmds, ok := c.data["CMDS"].(map[string]any)
 	if !ok {
 		panic("Malformed CMDS")
 	}
+	return readCommandConfig(cmds, true)
+}
+
+// context menu commands (on users or messages) are optional and have no description
+func (c Config) GetMenuConfig() map[string]CmdConf {
+	menus, ok := c.data["MENUS"].(map[string]any)
+	if !ok && c.data["MENUS"] != nil {
+		panic("Malformed MENUS")
+	}
+	return readCommandConfig(menus, false)
+}
 
-	res := map[string][2]string{}
+func readCommandConfig(cmds map[string]any, requireDesc bool) map[string]CmdConf {
+	res := map[string]CmdConf{}
 	for cmdName, cmdData := range cmds {
 		casted, ok := cmdData.(map[string]any)
 		if !ok {
@@ -160,42 +206,31 @@ func (c Config) GetCommandConfig() map[string][2]string {
 
 		if cmd, _ := casted["CMD"].(string); cmd != "" {
 			desc, _ := casted["DESCRIPTION"].(string)
-			if desc == "" {
+			if requireDesc && desc == "" {
 				panic("Command without DESCRIPTION : " + cmdName)
 			}
-			res[cmdName] = [2]string{cmd, desc}
+			permission, everyone := parsePermissions(toStringSlice(casted["PERMISSIONS"], cmdName), cmdName)
+			res[cmdName] = CmdConf{
+				Name: cmd, Description: desc, Roles: toStringSlice(casted["ROLES"], cmdName),
+				Users: toStringSlice(casted["USERS"], cmdName), Permission: permission, everyone: everyone,
+				Ephemeral: casted["EPHEMERAL"] == true,
+			}
 		}
 	}
 	return res
 }
 
-func (c Config) GetIdSet(namesConfName string, nameToId map[string]string) StringSet {
-	names, ok := c.data[namesConfName].([]any)
-	if !ok {
-		return nil
-	}
-	idSet := StringSet{}
-	for _, name := range names {
-		nameStr, ok := name.(string)
-		if !ok {
-			panic(fmt.Sprintf(notStringMsg, namesConfName, name, name))
-		}
-		id := nameToId[nameStr]
-		if id == "" {
-			panic("Unrecognized name : " + nameStr)
-		}
-		idSet[id] = Empty{}
-	}
-	return idSet
-}
-
 func (c Config) GetSlice(valuesConfName string) []any {
 	values, _ := c.data[valuesConfName].([]any)
 	return values
 }
 
 func (c Config) GetStringSlice(valuesConfName string) []string {
-	values, ok := c.data[valuesConfName].([]any)
+	return toStringSlice(c.data[valuesConfName], valuesConfName)
+}
+
+func toStringSlice(data any, confName string) []string {
+	values, ok := data.([]any)
 	if !ok {
 		return nil
 	}
@@ -203,13 +238,54 @@ func (c Config) GetStringSlice(valuesConfName string) []string {
 	for _, value := range values {
 		valueStr, ok := value.(string)
 		if !ok {
-			panic(fmt.Sprintf(notStringMsg, valuesConfName, value, value))
+			panic(fmt.Sprintf(notStringMsg, confName, value, value))
 		}
 		casted = append(casted, valueStr)
 	}
 	return casted
 }
 
+// return nil when the list is empty or contains EVERYONE
+func (c Config) GetPermission(valuesConfName string) *int64 {
+	permission, _ := parsePermissions(c.GetStringSlice(valuesConfName), valuesConfName)
+	return permission
+}
+
+// the boolean is true when the list contains EVERYONE
+func parsePermissions(names []string, confName string) (*int64, bool) {
+	if len(names) == 0 {
+		return nil, false
+	}
+
+	var permission int64
+	for _, name := range names {
+		if name == "EVERYONE" {
+			return nil, true
+		}
+
+		flag, ok := nameToPermission[name]
+		if !ok {
+			panic("Unknown permission in " + confName + " : " + name)
+		}
+		permission |= flag
+	}
+	return &permission, false
+}
+
+func (c Config) GetBool(valueConfName string) bool {
+	value, _ := c.data[valueConfName].(bool)
+	return value
+}
+
+func (c Config) GetInt(valueConfName string) int {
+	value := c.data[valueConfName]
+	valueInt, ok := value.(int)
+	if !ok {
+		log.Printf(notIntegerMsg, valueConfName, value, value)
+	}
+	return valueInt
+}
+
 func (c Config) GetDurationSec(valueConfName string) time.Duration {
 	value := c.data[valueConfName]
 	valueSec, ok := value.(int)
@@ -219,6 +295,15 @@ func (c Config) GetDurationSec(valueConfName string) time.Duration {
 	return time.Duration(valueSec) * time.Second
 }
 
+func (c Config) GetDurationDay(valueConfName string) time.Duration {
+	value := c.data[valueConfName]
+	valueDay, ok := value.(int)
+	if !ok {
+		log.Printf(notIntegerMsg, valueConfName, value, value)
+	}
+	return time.Duration(valueDay) * 24 * time.Hour
+}
+
 func (c Config) GetDelayMins(valuesConfName string) []time.Duration {
 	values, _ := c.data[valuesConfName].([]any)
 	delays := make([]time.Duration, 0, len(values))
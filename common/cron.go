@@ -0,0 +1,134 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errCronFieldNumber = errors.New("cron expression must have 5 fields (minute hour day-of-month month day-of-week)")
+
+// CronMatcher check a time against a cron like expression
+// (each field accept "*", a value, a range "a-b" and a step "/n" (after "*", a range or a start value), separated by commas)
+type CronMatcher struct {
+	minutes    uint64
+	hours      uint64
+	days       uint64
+	months     uint64
+	weekDays   uint64
+	anyDay     bool
+	anyWeekDay bool
+}
+
+func ParseCron(expr string) (CronMatcher, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return CronMatcher{}, errCronFieldNumber
+	}
+
+	var m CronMatcher
+	var err error
+	if m.minutes, err = parseCronField(fields[0], 0, 59); err != nil {
+		return m, err
+	}
+	if m.hours, err = parseCronField(fields[1], 0, 23); err != nil {
+		return m, err
+	}
+	if m.days, err = parseCronField(fields[2], 1, 31); err != nil {
+		return m, err
+	}
+	if m.months, err = parseCronField(fields[3], 1, 12); err != nil {
+		return m, err
+	}
+	// 7 is also accepted for sunday
+	if m.weekDays, err = parseCronField(fields[4], 0, 7); err != nil {
+		return m, err
+	}
+	if m.weekDays&(1<<7) != 0 {
+		m.weekDays |= 1
+	}
+	m.anyDay = fields[2] == "*"
+	m.anyWeekDay = fields[4] == "*"
+	return m, nil
+}
+
+func (m CronMatcher) Match(t time.Time) bool {
+	if !hasBit(m.minutes, t.Minute()) || !hasBit(m.hours, t.Hour()) || !hasBit(m.months, int(t.Month())) {
+		return false
+	}
+
+	dayMatch := hasBit(m.days, t.Day())
+	weekDayMatch := hasBit(m.weekDays, int(t.Weekday()))
+	// like in cron, when both day fields are restricted, matching one is enough
+	if !m.anyDay && !m.anyWeekDay {
+		return dayMatch || weekDayMatch
+	}
+	return dayMatch && weekDayMatch
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step, stepped := 1, false
+		if slashIndex := strings.IndexByte(part, '/'); slashIndex != -1 {
+			stepped = true
+			var err error
+			if step, err = strconv.Atoi(part[slashIndex+1:]); err != nil || step < 1 {
+				return 0, errors.New("invalid step in cron field : " + field)
+			}
+			part = part[:slashIndex]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			var err error
+			if dashIndex := strings.IndexByte(part, '-'); dashIndex == -1 {
+				if start, err = strconv.Atoi(part); err != nil {
+					return 0, errors.New("invalid value in cron field : " + field)
+				}
+				// like in cron, "a/n" start at a until the maximum
+				if !stepped {
+					end = start
+				}
+			} else {
+				if start, err = strconv.Atoi(part[:dashIndex]); err != nil {
+					return 0, errors.New("invalid range in cron field : " + field)
+				}
+				if end, err = strconv.Atoi(part[dashIndex+1:]); err != nil {
+					return 0, errors.New("invalid range in cron field : " + field)
+				}
+			}
+			if start < min || end > max || start > end {
+				return 0, errors.New("out of range value in cron field : " + field)
+			}
+		}
+
+		for value := start; value <= end; value += step {
+			bits |= 1 << value
+		}
+	}
+	return bits, nil
+}
+
+func hasBit(bits uint64, value int) bool {
+	return bits&(1<<value) != 0
+}
@@ -0,0 +1,102 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-2 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"1,,2 * * * *",
+	} {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("ParseCron(%q) should fail", expr)
+		}
+	}
+}
+
+func TestCronMatch(t *testing.T) {
+	// 2024-01-01 is a monday
+	monday := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for _, testCase := range []struct {
+		expr string
+		time time.Time
+		want bool
+	}{
+		{expr: "* * * * *", time: monday.Add(17 * time.Minute), want: true},
+		// values and lists
+		{expr: "30 9 * * *", time: monday.Add(9*time.Hour + 30*time.Minute), want: true},
+		{expr: "30 9 * * *", time: monday.Add(9*time.Hour + 31*time.Minute), want: false},
+		{expr: "0,15,45 * * * *", time: monday.Add(45 * time.Minute), want: true},
+		{expr: "0,15,45 * * * *", time: monday.Add(30 * time.Minute), want: false},
+		// ranges
+		{expr: "0 8-18 * * *", time: monday.Add(8 * time.Hour), want: true},
+		{expr: "0 8-18 * * *", time: monday.Add(18 * time.Hour), want: true},
+		{expr: "0 8-18 * * *", time: monday.Add(19 * time.Hour), want: false},
+		// steps
+		{expr: "*/15 * * * *", time: monday.Add(30 * time.Minute), want: true},
+		{expr: "*/15 * * * *", time: monday.Add(31 * time.Minute), want: false},
+		{expr: "10-30/10 * * * *", time: monday.Add(20 * time.Minute), want: true},
+		{expr: "10-30/10 * * * *", time: monday.Add(40 * time.Minute), want: false},
+		{expr: "5/20 * * * *", time: monday.Add(45 * time.Minute), want: true},
+		{expr: "5/20 * * * *", time: monday.Add(50 * time.Minute), want: false},
+		// months
+		{expr: "0 0 1 1 *", time: monday, want: true},
+		{expr: "0 0 1 2 *", time: monday, want: false},
+		// day of week (0 and 7 are sunday)
+		{expr: "0 0 * * 1", time: monday, want: true},
+		{expr: "0 0 * * 1-5", time: monday.AddDate(0, 0, 4), want: true},
+		{expr: "0 0 * * 1-5", time: monday.AddDate(0, 0, 5), want: false},
+		{expr: "0 0 * * 0", time: monday.AddDate(0, 0, 6), want: true},
+		{expr: "0 0 * * 7", time: monday.AddDate(0, 0, 6), want: true},
+		{expr: "0 0 * * 7", time: monday, want: false},
+		// restricted day of month and day of week : one is enough
+		{expr: "0 0 15 * 1", time: monday, want: true},
+		{expr: "0 0 15 * 1", time: monday.AddDate(0, 0, 14), want: true},
+		{expr: "0 0 15 * 1", time: monday.AddDate(0, 0, 1), want: false},
+		// only the day of month restricted
+		{expr: "0 0 2 * *", time: monday, want: false},
+		{expr: "0 0 2 * *", time: monday.AddDate(0, 0, 1), want: true},
+	} {
+		matcher, err := ParseCron(testCase.expr)
+		if err != nil {
+			t.Errorf("ParseCron(%q) failed : %v", testCase.expr, err)
+			continue
+		}
+		if got := matcher.Match(testCase.time); got != testCase.want {
+			t.Errorf("ParseCron(%q).Match(%v) = %v, want %v", testCase.expr, testCase.time, got, testCase.want)
+		}
+	}
+}
@@ -20,6 +20,9 @@ package common
 
 import (
 	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
 	"log"
 	"math/rand"
 	"os"
@@ -28,6 +31,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
@@ -38,11 +42,15 @@ import (
 // (as stated in Session.GuildMembers documentation)
 const MemberCallLimit = 1000
 
+// max number of messages waiting in the queue of a channel sender
+const messageQueueSize = 32
+
 const (
 	CmdPlaceHolder      = "{{cmd}}"
 	NumErrorPlaceHolder = "{{numError}}"
 	RolePlaceHolder     = "{{role}}"
 	GroupPlaceHolder    = "{{group}}"
+	UserPlaceHolder     = "{{user}}"
 )
 
 type (
@@ -50,22 +58,83 @@ type (
 	StringSet = map[string]Empty
 )
 
+// roles and users allowed to use a command
+type CmdAccess struct {
+	RoleIds StringSet
+	UserIds StringSet
+}
+
 type GuildAndConfInfo struct {
 	GuildId                    string
 	OwnerId                    string
 	DefaultRoleId              string
+	JoiningRoleId              string
 	AuthorizedRoleIds          StringSet
 	ForbiddenRoleIds           StringSet
 	IgnoredRoleIds             StringSet
 	ForbiddenAndIgnoredRoleIds StringSet
 	CmdRoleIds                 StringSet
 	SpecialRoleIds             StringSet
+	CountFilterRoleIds         StringSet
 	RoleIdToPrefix             map[string]string
 	Prefixes                   []string
 	RoleIdToDisplayName        map[string]string
+	CmdToRoleId                map[string]string
+	RoleIdToGroup              map[string]string
+	InviteToRoleId             map[string]string
+	QuarantineRoleId           string
+	CmdToAccess                map[string]CmdAccess
+	EphemeralCmds              StringSet
 	Msgs                       Messages
 }
 
+// check the member against the roles and users configured for the command (AUTHORIZED_ROLES when there is none),
+// the command visibility on Discord side is not enough
+func (infos GuildAndConfInfo) Authorized(i *discordgo.InteractionCreate) bool {
+	return infos.AuthorizedMember(i.Member, i.ApplicationCommandData().Name)
+}
+
+func (infos GuildAndConfInfo) AuthorizedMember(member *discordgo.Member, cmdName string) bool {
+	access, ok := infos.CmdToAccess[cmdName]
+	if !ok {
+		return IdInSet(member.Roles, infos.AuthorizedRoleIds)
+	}
+	if _, ok = access.UserIds[member.User.ID]; ok {
+		return true
+	}
+	return IdInSet(member.Roles, access.RoleIds)
+}
+
+// a public command is only checked when ROLES or USERS are configured for it
+func (infos GuildAndConfInfo) AuthorizedPublicMember(member *discordgo.Member, cmdName string) bool {
+	if _, restricted := infos.CmdToAccess[cmdName]; restricted {
+		return infos.AuthorizedMember(member, cmdName)
+	}
+	return true
+}
+
+// InfosHolder share the current GuildAndConfInfo (which is rebuilt when the guild roles change)
+type InfosHolder struct {
+	infos GuildAndConfInfo
+	mutex sync.RWMutex
+}
+
+func MakeInfosHolder(infos GuildAndConfInfo) InfosHolder {
+	return InfosHolder{infos: infos}
+}
+
+func (h *InfosHolder) Get() GuildAndConfInfo {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return h.infos
+}
+
+func (h *InfosHolder) Set(infos GuildAndConfInfo) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.infos = infos
+}
+
 type Messages struct {
 	Ok              string
 	ErrUnauthorized string
@@ -89,38 +158,92 @@ func (m Messages) ReplaceCmdPlaceHolder(cmdName string) Messages {
 	return m
 }
 
-type IdMonitor struct {
-	processing StringSet
-	mutex      sync.RWMutex
+type queuedTask struct {
+	run func()
 }
 
-func MakeIdMonitor() IdMonitor {
-	return IdMonitor{processing: StringSet{}}
+type memberTasks struct {
+	tasks []*queuedTask
+	// last queued update not yet started (could be replaced by a newer one)
+	pendingUpdate *queuedTask
 }
 
-func (m *IdMonitor) StopProcessing(id string) {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	delete(m.processing, id)
+// MemberQueue serializes the operations on each member (by user id),
+// a worker goroutine is started for an id while there is queued tasks for it
+type MemberQueue struct {
+	idToTasks map[string]*memberTasks
+	mutex     sync.Mutex
 }
 
-func (m *IdMonitor) StartProcessing(id string) bool {
-	m.mutex.RLock()
-	_, processing := m.processing[id]
-	m.mutex.RUnlock()
-	if processing {
-		return false
+func MakeMemberQueue() MemberQueue {
+	return MemberQueue{idToTasks: map[string]*memberTasks{}}
+}
+
+// Run task after the previously queued ones for the same id and wait for its end
+func (q *MemberQueue) Do(id string, task func()) {
+	done := make(chan Empty)
+	q.push(id, &queuedTask{run: func() {
+		defer close(done)
+		task()
+	}}, false)
+	<-done
+}
+
+// Queue task without waiting, a still pending update for the same id is dropped
+// (the newer one reflect the latest state of the member)
+func (q *MemberQueue) Update(id string, task func()) {
+	q.push(id, &queuedTask{run: task}, true)
+}
+
+func (q *MemberQueue) push(id string, task *queuedTask, update bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	tasks, working := q.idToTasks[id]
+	if !working {
+		tasks = &memberTasks{}
+		q.idToTasks[id] = tasks
+	}
+	if update {
+		if pendingUpdate := tasks.pendingUpdate; pendingUpdate != nil {
+			pendingUpdate.run = nil
+			UpdatesSkipped.Inc("")
+		}
+		tasks.pendingUpdate = task
 	}
+	tasks.tasks = append(tasks.tasks, task)
+	if !working {
+		go q.work(id, tasks)
+	}
+}
 
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
-	// verify there was no change between lock
-	_, processing = m.processing[id]
-	if processing {
-		return false
+func (q *MemberQueue) work(id string, tasks *memberTasks) {
+	for {
+		if run, ok := q.pop(id, tasks); !ok {
+			return
+		} else if run != nil {
+			run()
+		}
 	}
-	m.processing[id] = Empty{}
-	return true
+}
+
+func (q *MemberQueue) pop(id string, tasks *memberTasks) (func(), bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(tasks.tasks) == 0 {
+		delete(q.idToTasks, id)
+		return nil, false
+	}
+
+	task := tasks.tasks[0]
+	tasks.tasks[0] = nil // for GC cleaning
+	tasks.tasks = tasks.tasks[1:]
+	if task == tasks.pendingUpdate {
+		tasks.pendingUpdate = nil
+	}
+	// a nil run is a dropped update
+	return task.run, true
 }
 
 type MultipartMessage struct {
@@ -129,29 +252,154 @@ type MultipartMessage struct {
 	FileData   string
 	ErrorMsg   string
 	AllowMerge bool
+	// only used with a message (and without AllowMerge)
+	Components []discordgo.MessageComponent
+	// could be sent without message (but not with a file)
+	Embeds []*discordgo.MessageEmbed
 }
 
+// ChannelSenderManager keep a message sender by channel,
+// and a sender by target (configuration name) following the channel associated with the target
 type ChannelSenderManager struct {
-	channels map[string]chan<- MultipartMessage
-	session  *discordgo.Session
+	channels   map[string]chan<- MultipartMessage
+	targets    map[string]chan<- MultipartMessage
+	targetToId map[string]string
+	session    *discordgo.Session
+	mutex      *sync.RWMutex
+	// number of messages received by a sender goroutine and not yet sent
+	sending *atomic.Int64
 }
 
 func MakeChannelSenderManager(session *discordgo.Session) ChannelSenderManager {
-	return ChannelSenderManager{channels: map[string]chan<- MultipartMessage{}, session: session}
+	return ChannelSenderManager{
+		channels: map[string]chan<- MultipartMessage{}, targets: map[string]chan<- MultipartMessage{},
+		targetToId: map[string]string{}, session: session, mutex: &sync.RWMutex{}, sending: &atomic.Int64{},
+	}
 }
 
 func (m ChannelSenderManager) AddChannel(channelId string) {
 	if channelId != "" {
-		if _, ok := m.channels[channelId]; !ok {
-			m.channels[channelId] = createMessageSender(m.session, channelId)
-		}
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		m.addChannel(channelId)
+	}
+}
+
+// should be called with the lock
+func (m ChannelSenderManager) addChannel(channelId string) {
+	if _, ok := m.channels[channelId]; !ok {
+		messageChan := make(chan MultipartMessage, messageQueueSize)
+		go m.sendMultiMessage(channelId, messageChan)
+		m.channels[channelId] = messageChan
 	}
 }
 
 func (m ChannelSenderManager) Get(channelId string) chan<- MultipartMessage {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
 	return m.channels[channelId]
 }
 
+// associate the target with the channel (an empty channelId disable the target)
+func (m ChannelSenderManager) SetTarget(target string, channelId string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if channelId != "" {
+		m.addChannel(channelId)
+	}
+	m.targetToId[target] = channelId
+	if _, ok := m.targets[target]; !ok {
+		targetChan := make(chan MultipartMessage, messageQueueSize)
+		go m.forward(target, targetChan)
+		m.targets[target] = targetChan
+	}
+}
+
+// return nil for unknown target
+func (m ChannelSenderManager) GetTarget(target string) chan<- MultipartMessage {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.targets[target]
+}
+
+func (m ChannelSenderManager) GetTargetChannel(target string) string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.targetToId[target]
+}
+
+// return the distinct channels associated with a target
+func (m ChannelSenderManager) GetTargetChannels() []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	channelIds := make([]string, 0, len(m.targetToId))
+	for _, channelId := range m.targetToId {
+		if channelId != "" && !slices.Contains(channelIds, channelId) {
+			channelIds = append(channelIds, channelId)
+		}
+	}
+	slices.Sort(channelIds)
+	return channelIds
+}
+
+func (m ChannelSenderManager) forward(target string, messageReceiver <-chan MultipartMessage) {
+	for multiMessage := range messageReceiver {
+		m.sending.Add(1)
+		m.mutex.RLock()
+		messageSender := m.channels[m.targetToId[target]]
+		m.mutex.RUnlock()
+
+		if messageSender == nil {
+			log.Println("Message dropped, no channel for target :", target)
+		} else {
+			messageSender <- multiMessage
+		}
+		m.sending.Add(-1)
+	}
+}
+
+func (m ChannelSenderManager) sendMultiMessage(channelId string, messageReceiver <-chan MultipartMessage) {
+	for multiMessage := range messageReceiver {
+		m.sending.Add(1)
+		SendMultipartMessage(m.session, channelId, multiMessage)
+		m.sending.Add(-1)
+	}
+}
+
+// return the number of messages waiting in the queues or being sent
+func (m ChannelSenderManager) pending() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	count := int(m.sending.Load())
+	for _, messageSender := range m.channels {
+		count += len(messageSender)
+	}
+	for _, messageSender := range m.targets {
+		count += len(messageSender)
+	}
+	return count
+}
+
+// wait until the queues stay empty during a check interval (the producers could be sending their last messages),
+// return the number of messages still pending at the timeout
+func (m ChannelSenderManager) Drain(timeout time.Duration) int {
+	const checkInterval = 200 * time.Millisecond
+
+	deadline := time.Now().Add(timeout)
+	previous := -1
+	for {
+		current := m.pending()
+		if current == 0 && previous == 0 {
+			return 0
+		}
+		if time.Now().After(deadline) {
+			return current
+		}
+		previous = current
+		time.Sleep(checkInterval)
+	}
+}
+
 func LogBeforeShutdown() {
 	if err := recover(); err != nil {
 		log.Println(err)
@@ -174,18 +422,6 @@ func CleanMessage(msg string) string {
 	return string(newMsg)
 }
 
-func InitIdSet(names []string, nameToId map[string]string) StringSet {
-	idSet := StringSet{}
-	for _, name := range names {
-		id := nameToId[name]
-		if id == "" {
-			panic("Unrecognized name (2) : " + name)
-		}
-		idSet[id] = Empty{}
-	}
-	return idSet
-}
-
 func IdInSet(ids []string, idSet StringSet) bool {
 	for _, id := range ids {
 		if _, ok := idSet[id]; ok {
@@ -204,13 +440,94 @@ func IdMatch(ids []string, idToValue map[string]string, targetValue string) bool
 	return false
 }
 
-func AppendCommand(cmds []*discordgo.ApplicationCommand, cmdData [2]string, options []*discordgo.ApplicationCommandOption) (string, []*discordgo.ApplicationCommand) {
-	if cmdData[0] != "" {
+func AppendCommand(cmds []*discordgo.ApplicationCommand, cmdConf CmdConf, options []*discordgo.ApplicationCommandOption) (string, []*discordgo.ApplicationCommand) {
+	if cmdConf.Name != "" {
+		cmds = append(cmds, &discordgo.ApplicationCommand{
+			Name: cmdConf.Name, Description: cmdConf.Description, Options: options,
+			DefaultMemberPermissions: cmdConf.Permission,
+		})
+	}
+	return cmdConf.Name, cmds
+}
+
+// create, update or delete the guild commands to match the wanted ones (the commands stay in place between restarts),
+// return the problems of the commands which could not be created or updated
+func SyncCommands(s *discordgo.Session, appId string, guildId string, cmds []*discordgo.ApplicationCommand) []string {
+	registered, err := s.ApplicationCommands(appId, guildId)
+	if err != nil {
+		log.Println("Cannot retrieve the registered commands :", err)
+		return []string{fmt.Sprint("Cannot retrieve the registered commands : ", err)}
+	}
+
+	keyToRegistered := make(map[string]*discordgo.ApplicationCommand, len(registered))
+	for _, cmd := range registered {
+		keyToRegistered[commandKey(cmd)] = cmd
+	}
+
+	var problems []string
+	for _, cmd := range cmds {
+		key := commandKey(cmd)
+		previous, ok := keyToRegistered[key]
+		switch {
+		case !ok:
+			if _, err = s.ApplicationCommandCreate(appId, guildId, cmd); err != nil {
+				log.Println("Cannot create", cmd.Name, "command :", err)
+				problems = append(problems, fmt.Sprint("Cannot create ", cmd.Name, " command : ", err))
+			}
+		case !sameCommand(previous, cmd):
+			if _, err = s.ApplicationCommandEdit(appId, guildId, previous.ID, cmd); err != nil {
+				log.Println("Cannot update", cmd.Name, "command :", err)
+				problems = append(problems, fmt.Sprint("Cannot update ", cmd.Name, " command : ", err))
+			}
+		}
+		delete(keyToRegistered, key)
+	}
+
+	// remaining ones are no longer wanted
+	for _, cmd := range keyToRegistered {
+		if err = s.ApplicationCommandDelete(appId, guildId, cmd.ID); err != nil {
+			log.Println("Cannot delete", cmd.Name, "command :", err)
+		}
+	}
+	return problems
+}
+
+// slash commands and context menu commands can share a name
+func commandKey(cmd *discordgo.ApplicationCommand) string {
+	cmdType := cmd.Type
+	if cmdType == 0 {
+		cmdType = discordgo.ChatApplicationCommand
+	}
+	return strconv.Itoa(int(cmdType)) + cmd.Name
+}
+
+func sameCommand(registered *discordgo.ApplicationCommand, wanted *discordgo.ApplicationCommand) bool {
+	if registered.Description != wanted.Description {
+		return false
+	}
+	registeredPermission, wantedPermission := registered.DefaultMemberPermissions, wanted.DefaultMemberPermissions
+	if (registeredPermission == nil) != (wantedPermission == nil) || (wantedPermission != nil && *registeredPermission != *wantedPermission) {
+		return false
+	}
+	// options are compared through their serialization
+	registeredOptions, err := json.Marshal(registered.Options)
+	if err != nil {
+		return false
+	}
+	wantedOptions, err := json.Marshal(wanted.Options)
+	if err != nil {
+		return false
+	}
+	return string(registeredOptions) == string(wantedOptions) || (len(registered.Options) == 0 && len(wanted.Options) == 0)
+}
+
+func AppendMenu(cmds []*discordgo.ApplicationCommand, cmdConf CmdConf, menuType discordgo.ApplicationCommandType) (string, []*discordgo.ApplicationCommand) {
+	if cmdConf.Name != "" {
 		cmds = append(cmds, &discordgo.ApplicationCommand{
-			Name: cmdData[0], Description: cmdData[1], Options: options,
+			Type: menuType, Name: cmdConf.Name, DefaultMemberPermissions: cmdConf.Permission,
 		})
 	}
-	return cmdData[0], cmds
+	return cmdConf.Name, cmds
 }
 
 func AddNonEmpty[T any](m map[string]T, name string, value T) {
@@ -221,27 +538,90 @@ func AddNonEmpty[T any](m map[string]T, name string, value T) {
 
 func AuthorizedCmd(s *discordgo.Session, i *discordgo.InteractionCreate, infos GuildAndConfInfo, cmdEffect func() string) {
 	returnMsg := infos.Msgs.ErrUnauthorized
-	if IdInSet(i.Member.Roles, infos.AuthorizedRoleIds) {
+	if infos.Authorized(i) {
 		returnMsg = cmdEffect()
 	}
+	RespondCmd(s, i, infos, returnMsg)
+}
 
-	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-		Type: discordgo.InteractionResponseChannelMessageWithSource,
-		Data: &discordgo.InteractionResponseData{Content: returnMsg},
+// the cmdEffect is called after the acknowledgement (for commands doing I/O before responding)
+func AuthorizedDeferredCmd(s *discordgo.Session, i *discordgo.InteractionCreate, infos GuildAndConfInfo, cmdEffect func() string) {
+	if !infos.Authorized(i) {
+		RespondCmd(s, i, infos, infos.Msgs.ErrUnauthorized)
+		return
+	}
+
+	DeferCmd(s, i, infos, func() *discordgo.WebhookEdit {
+		returnMsg := cmdEffect()
+		return &discordgo.WebhookEdit{Content: &returnMsg}
 	})
 }
 
-func MembersCmd(s *discordgo.Session, i *discordgo.InteractionCreate, messageSender chan<- MultipartMessage, infos GuildAndConfInfo, msgs Messages, userMonitor *IdMonitor, cmdEffect func(*discordgo.Member) int) {
-	AuthorizedCmd(s, i, infos, func() string {
-		go processMembers(s, messageSender, infos.GuildId, msgs, userMonitor, cmdEffect)
-		return msgs.Ok
-	})
+func (infos GuildAndConfInfo) ResponseFlags(i *discordgo.InteractionCreate) discordgo.MessageFlags {
+	if _, ok := infos.EphemeralCmds[i.ApplicationCommandData().Name]; ok {
+		return discordgo.MessageFlagsEphemeral
+	}
+	return 0
 }
 
-func processMembers(s *discordgo.Session, messageSender chan<- MultipartMessage, guildId string, msgs Messages, userMonitor *IdMonitor, cmdEffect func(*discordgo.Member) int) {
+func RespondCmd(s *discordgo.Session, i *discordgo.InteractionCreate, infos GuildAndConfInfo, msg string) {
+	if err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Content: msg, Flags: infos.ResponseFlags(i)},
+	}); err != nil {
+		log.Println("Interaction response failed :", err)
+		CommandsFailed.Inc(i.ApplicationCommandData().Name)
+	} else if infos.Msgs.isError(msg) {
+		CommandsFailed.Inc(i.ApplicationCommandData().Name)
+	}
+}
+
+// match the global error messages (with or without the command name) or the partial one (whatever the number of errors)
+func (msgs Messages) isError(msg string) bool {
+	return msg == msgs.ErrGlobal || msg == msgs.ErrGlobalCmd || matchPlaceHolder(msgs.ErrGlobalCmd, CmdPlaceHolder, msg) ||
+		matchPlaceHolder(msgs.ErrPartial, NumErrorPlaceHolder, msg)
+}
+
+// match the template with any non empty value for the placeholder
+func matchPlaceHolder(template string, placeHolder string, msg string) bool {
+	before, after, found := strings.Cut(template, placeHolder)
+	return found && len(msg) > len(before)+len(after) && strings.HasPrefix(msg, before) && strings.HasSuffix(msg, after)
+}
+
+// acknowledge the interaction before calling cmdEffect (Discord wait a response only 3 seconds),
+// then edit the response with the returned data
+func DeferCmd(s *discordgo.Session, i *discordgo.InteractionCreate, infos GuildAndConfInfo, cmdEffect func() *discordgo.WebhookEdit) {
+	if err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{Flags: infos.ResponseFlags(i)},
+	}); err != nil {
+		log.Println("Interaction deferring failed :", err)
+		CommandsFailed.Inc(i.ApplicationCommandData().Name)
+		return
+	}
+
+	edit := cmdEffect()
+	if _, err := s.InteractionResponseEdit(i.Interaction, edit); err != nil {
+		log.Println("Interaction response edit failed :", err)
+		CommandsFailed.Inc(i.ApplicationCommandData().Name)
+	} else if edit.Content != nil && infos.Msgs.isError(*edit.Content) {
+		CommandsFailed.Inc(i.ApplicationCommandData().Name)
+	}
+}
+
+// retrieve and process the guild members, then send the ending message
+// (prepare is optional, when present it is called with the members before the processing, which is aborted on error)
+func ProcessGuildMembers(s *discordgo.Session, messageSender chan<- MultipartMessage, guildId string, msgs Messages, memberQueue *MemberQueue, prepare func([]*discordgo.Member) error, cmdEffect func(*discordgo.Member) int) {
 	msg := msgs.EndedCmd
 	if guildMembers, err := s.GuildMembers(guildId, "", MemberCallLimit); err == nil {
-		if counterError := ProcessMembers(guildMembers, userMonitor, cmdEffect); counterError != 0 {
+		if prepare != nil {
+			if err = prepare(guildMembers); err != nil {
+				log.Println("Members processing preparation failed :", err)
+				messageSender <- MultipartMessage{Message: msgs.ErrGlobalCmd}
+				return
+			}
+		}
+		if counterError := ProcessMembers(guildMembers, memberQueue, cmdEffect); counterError != 0 {
 			msg = strings.ReplaceAll(msgs.ErrPartialCmd, NumErrorPlaceHolder, strconv.Itoa(counterError))
 		}
 	} else {
@@ -251,13 +631,12 @@ func processMembers(s *discordgo.Session, messageSender chan<- MultipartMessage,
 	messageSender <- MultipartMessage{Message: msg}
 }
 
-func ProcessMembers(guildMembers []*discordgo.Member, userMonitor *IdMonitor, cmdEffect func(*discordgo.Member) int) int {
+func ProcessMembers(guildMembers []*discordgo.Member, memberQueue *MemberQueue, cmdEffect func(*discordgo.Member) int) int {
 	counterError := 0
 	for _, member := range guildMembers {
-		if userId := member.User.ID; userMonitor.StartProcessing(userId) {
+		memberQueue.Do(member.User.ID, func() {
 			counterError += cmdEffect(member)
-			userMonitor.StopProcessing(userId)
-		}
+		})
 	}
 	return counterError
 }
@@ -273,41 +652,63 @@ func ExtractNick(member *discordgo.Member) (nick string) {
 	return user.Username
 }
 
-func createMessageSender(session *discordgo.Session, channelId string) chan<- MultipartMessage {
-	messageChan := make(chan MultipartMessage)
-	go sendMultiMessage(session, channelId, messageChan)
-	return messageChan
+func SendDirectMessage(s *discordgo.Session, userId string, msg string) error {
+	channel, err := s.UserChannelCreate(userId)
+	if err == nil {
+		_, err = s.ChannelMessageSend(channel.ID, msg)
+	}
+	return err
 }
 
-func sendMultiMessage(session *discordgo.Session, channelId string, messageReceiver <-chan MultipartMessage) {
-	for multiMessage := range messageReceiver {
-		if message := strings.TrimSpace(multiMessage.Message); message == "" {
-			if multiMessage.FileName != "" && multiMessage.FileData != "" {
-				if sendFile(session, channelId, multiMessage.FileName, multiMessage.FileData) && multiMessage.ErrorMsg != "" {
-					if _, err := session.ChannelMessageSend(channelId, multiMessage.ErrorMsg); err != nil {
-						log.Println("Message sending failed (2) :", err)
-					}
+// send directly (without the goroutine associated with the channel, useful for private channels)
+func SendMultipartMessage(session *discordgo.Session, channelId string, multiMessage MultipartMessage) {
+	if len(multiMessage.Embeds) != 0 {
+		if _, err := session.ChannelMessageSendComplex(channelId, &discordgo.MessageSend{
+			Content: strings.TrimSpace(multiMessage.Message), Components: multiMessage.Components, Embeds: multiMessage.Embeds,
+		}); err != nil {
+			log.Println("Message with embeds sending failed :", err)
+			SendFailures.Inc(channelId)
+		}
+	} else if message := strings.TrimSpace(multiMessage.Message); message == "" {
+		if multiMessage.FileName != "" && multiMessage.FileData != "" {
+			if sendFile(session, channelId, multiMessage.FileName, multiMessage.FileData) && multiMessage.ErrorMsg != "" {
+				if _, err := session.ChannelMessageSend(channelId, multiMessage.ErrorMsg); err != nil {
+					log.Println("Message sending failed (2) :", err)
+					SendFailures.Inc(channelId)
 				}
 			}
+		}
+	} else {
+		if multiMessage.FileName == "" || multiMessage.FileData == "" {
+			if len(multiMessage.Components) != 0 {
+				if _, err := session.ChannelMessageSendComplex(channelId, &discordgo.MessageSend{
+					Content: message, Components: multiMessage.Components,
+				}); err != nil {
+					log.Println("Message with components sending failed :", err)
+					SendFailures.Inc(channelId)
+				}
+			} else if _, err := session.ChannelMessageSend(channelId, message); err != nil {
+				log.Println("Message sending failed :", err)
+				SendFailures.Inc(channelId)
+			}
 		} else {
-			if multiMessage.FileName == "" || multiMessage.FileData == "" {
-				if _, err := session.ChannelMessageSend(channelId, message); err != nil {
-					log.Println("Message sending failed :", err)
+			if multiMessage.AllowMerge && len(multiMessage.Message)+len(multiMessage.FileData) < 2000 {
+				var builder strings.Builder
+				builder.WriteString(message)
+				builder.WriteByte('\n')
+				builder.WriteString(multiMessage.FileData)
+				if _, err := session.ChannelMessageSend(channelId, builder.String()); err != nil {
+					log.Println("Message sending failed (3) :", err)
+					SendFailures.Inc(channelId)
 				}
 			} else {
-				if multiMessage.AllowMerge && len(multiMessage.Message)+len(multiMessage.FileData) < 2000 {
-					var builder strings.Builder
-					builder.WriteString(message)
-					builder.WriteByte('\n')
-					builder.WriteString(multiMessage.FileData)
-					if _, err := session.ChannelMessageSend(channelId, builder.String()); err != nil {
-						log.Println("Message sending failed (3) :", err)
-					}
-				} else {
-					dataReader := strings.NewReader(multiMessage.FileData)
-					if _, err := session.ChannelFileSendWithMessage(channelId, message, multiMessage.FileName, dataReader); err != nil {
-						log.Println("Message with file sending failed :", err)
-					}
+				dataReader := strings.NewReader(multiMessage.FileData)
+				if _, err := session.ChannelMessageSendComplex(channelId, &discordgo.MessageSend{
+					Content: message, Components: multiMessage.Components,
+					Files: []*discordgo.File{{Name: multiMessage.FileName, Reader: dataReader}},
+				}); err != nil {
+					log.Println("Message with file sending failed :", err)
+					SendFailures.Inc(channelId)
 				}
 			}
 		}
@@ -318,36 +719,50 @@ func sendFile(session *discordgo.Session, channelId string, path string, data st
 	dataReader := strings.NewReader(data)
 	if _, err := session.ChannelFileSend(channelId, path, dataReader); err != nil {
 		log.Println("File sending failed :", err)
+		SendFailures.Inc(channelId)
 		return true
 	}
 	return false
 }
 
-func LaunchTickers(number int, interval time.Duration) []chan time.Time {
+// the sub tickers are closed when the context is done
+func LaunchTickers(ctx context.Context, number int, interval time.Duration) []chan time.Time {
 	subTickers := make([]chan time.Time, number)
 	for index := range subTickers {
 		subTickers[index] = make(chan time.Time, 1)
 	}
-	go startDispatchTick(interval, subTickers)
+	go startDispatchTick(ctx, interval, subTickers)
 	return subTickers
 }
 
-func startDispatchTick(interval time.Duration, subTickers []chan time.Time) {
-	dispatchTick(time.Now(), subTickers)
-	for newTime := range time.Tick(interval) {
-		dispatchTick(newTime, subTickers)
+func startDispatchTick(ctx context.Context, interval time.Duration, subTickers []chan time.Time) {
+	defer closeTickers(subTickers)
+
+	dispatchTick(ctx, time.Now(), subTickers)
+	for newTime := range Tick(ctx, interval) {
+		dispatchTick(ctx, newTime, subTickers)
 	}
 }
 
-func dispatchTick(newTime time.Time, subTickers []chan time.Time) {
+func closeTickers(subTickers []chan time.Time) {
 	for _, subTicker := range subTickers {
-		subTicker <- newTime
+		close(subTicker)
 	}
 }
 
-func UpdateGameStatus(session *discordgo.Session, games []string, interval time.Duration) {
+func dispatchTick(ctx context.Context, newTime time.Time, subTickers []chan time.Time) {
+	for _, subTicker := range subTickers {
+		select {
+		case subTicker <- newTime:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func UpdateGameStatus(ctx context.Context, session *discordgo.Session, games []string, interval time.Duration) {
 	if gamesLen := len(games); gamesLen != 0 {
-		for range time.Tick(interval) {
+		for range Tick(ctx, interval) {
 			session.UpdateGameStatus(0, games[rand.Intn(gamesLen)])
 		}
 	}
@@ -399,8 +814,46 @@ func cmpNameValueAsc(a [2]string, b [2]string) int {
 	return cmp.Compare(a[0], b[0])
 }
 
-func SendTick(tickSender chan<- bool, interval time.Duration) {
-	for range time.Tick(interval) {
-		tickSender <- false
+func SendTick(ctx context.Context, tickSender chan<- bool, interval time.Duration) {
+	for range Tick(ctx, interval) {
+		select {
+		case tickSender <- false:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// like time.Tick, but the channel is closed when the context is done
+// (without tick when the interval is not positive)
+func Tick(ctx context.Context, interval time.Duration) <-chan time.Time {
+	tickChan := make(chan time.Time)
+	if interval <= 0 {
+		go closeWhenDone(ctx, tickChan)
+	} else {
+		go forwardTick(ctx, time.NewTicker(interval), tickChan)
+	}
+	return tickChan
+}
+
+func closeWhenDone(ctx context.Context, tickSender chan<- time.Time) {
+	<-ctx.Done()
+	close(tickSender)
+}
+
+func forwardTick(ctx context.Context, ticker *time.Ticker, tickSender chan<- time.Time) {
+	defer close(tickSender)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case newTime := <-ticker.C:
+			select {
+			case tickSender <- newTime:
+			case <-ctx.Done():
+				return
+			}
+		}
 	}
 }
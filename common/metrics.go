@@ -0,0 +1,214 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"bufio"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics exposed in the Prometheus text format (https://prometheus.io/docs/instrumenting/exposition_formats/)
+var (
+	CommandsRun       = newMetricVec("casiusbot_commands_total", "Commands and context menus run.", "counter", "command")
+	CommandsFailed    = newMetricVec("casiusbot_commands_failed_total", "Commands and context menus responding with an error.", "counter", "command")
+	ApiErrors         = newMetricVec("casiusbot_api_errors_total", "Discord API errors counted in the command errors (role, nickname or member retrieval).", "counter", "kind")
+	RssFetchDurations = newHistogramVec("casiusbot_rss_fetch_duration_seconds", "Duration of the RSS feed fetches.", "feed", []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30})
+	RssFetchErrors    = newMetricVec("casiusbot_rss_fetch_errors_total", "RSS feed fetches failed.", "counter", "feed")
+	ItemsPosted       = newMetricVec("casiusbot_rss_items_posted_total", "RSS items posted.", "counter", "feed")
+	DeepLCharacters   = newMetricVec("casiusbot_deepl_characters_total", "Characters sent to DeepL for translation.", "counter", "")
+	DeepLUsed         = newMetricVec("casiusbot_deepl_characters_used", "Characters used on the DeepL account (at the last check).", "gauge", "")
+	DeepLRemaining    = newMetricVec("casiusbot_deepl_characters_remaining", "Characters remaining on the DeepL account (at the last check).", "gauge", "")
+	SendFailures      = newMetricVec("casiusbot_message_send_failures_total", "Messages which could not be sent.", "counter", "channel")
+	UpdatesSkipped    = newMetricVec("casiusbot_member_updates_skipped_total", "Member updates skipped because a newer one was queued.", "counter", "")
+	Reconnects        = newMetricVec("casiusbot_gateway_reconnects_total", "Gateway connections after the first one.", "counter", "")
+	ActivityEvents    = newMetricVec("casiusbot_activity_events_total", "Member activity events processed.", "counter", "kind")
+)
+
+var metricRegistry []metricWriter
+
+type metricWriter interface {
+	write(writer *bufio.Writer)
+}
+
+// MetricVec is a counter or a gauge, with at most one label (an empty labelName for none)
+type MetricVec struct {
+	name          string
+	help          string
+	metricType    string
+	labelName     string
+	labelToValues map[string]float64
+	mutex         sync.Mutex
+}
+
+func newMetricVec(name string, help string, metricType string, labelName string) *MetricVec {
+	metric := &MetricVec{name: name, help: help, metricType: metricType, labelName: labelName, labelToValues: map[string]float64{}}
+	if labelName == "" {
+		// always exposed
+		metric.labelToValues[""] = 0
+	}
+	metricRegistry = append(metricRegistry, metric)
+	return metric
+}
+
+func (m *MetricVec) Inc(label string) {
+	m.Add(label, 1)
+}
+
+func (m *MetricVec) Add(label string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.labelToValues[label] += value
+}
+
+func (m *MetricVec) Set(label string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.labelToValues[label] = value
+}
+
+func (m *MetricVec) write(writer *bufio.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	writeHeader(writer, m.name, m.help, m.metricType)
+	for _, label := range slices.Sorted(maps.Keys(m.labelToValues)) {
+		writeSample(writer, m.name, m.labelName, label, "", "", m.labelToValues[label])
+	}
+}
+
+type histogram struct {
+	counts []uint64 // by bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec count the observations in buckets, with one label
+type HistogramVec struct {
+	name          string
+	help          string
+	labelName     string
+	buckets       []float64
+	labelToValues map[string]*histogram
+	mutex         sync.Mutex
+}
+
+func newHistogramVec(name string, help string, labelName string, buckets []float64) *HistogramVec {
+	metric := &HistogramVec{name: name, help: help, labelName: labelName, buckets: buckets, labelToValues: map[string]*histogram{}}
+	metricRegistry = append(metricRegistry, metric)
+	return metric
+}
+
+func (h *HistogramVec) ObserveDuration(label string, start time.Time) {
+	h.Observe(label, time.Since(start).Seconds())
+}
+
+func (h *HistogramVec) Observe(label string, value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	values, ok := h.labelToValues[label]
+	if !ok {
+		values = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.labelToValues[label] = values
+	}
+	if index, _ := slices.BinarySearch(h.buckets, value); index < len(h.buckets) {
+		values.counts[index]++
+	}
+	values.sum += value
+	values.count++
+}
+
+func (h *HistogramVec) write(writer *bufio.Writer) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	writeHeader(writer, h.name, h.help, "histogram")
+	for _, label := range slices.Sorted(maps.Keys(h.labelToValues)) {
+		values := h.labelToValues[label]
+		var cumulative uint64
+		for index, bucket := range h.buckets {
+			cumulative += values.counts[index]
+			writeSample(writer, h.name+"_bucket", h.labelName, label, "le", formatFloat(bucket), float64(cumulative))
+		}
+		writeSample(writer, h.name+"_bucket", h.labelName, label, "le", "+Inf", float64(values.count))
+		writeSample(writer, h.name+"_sum", h.labelName, label, "", "", values.sum)
+		writeSample(writer, h.name+"_count", h.labelName, label, "", "", float64(values.count))
+	}
+}
+
+func writeHeader(writer *bufio.Writer, name string, help string, metricType string) {
+	writer.WriteString("# HELP ")
+	writer.WriteString(name)
+	writer.WriteByte(' ')
+	writer.WriteString(help)
+	writer.WriteString("\n# TYPE ")
+	writer.WriteString(name)
+	writer.WriteByte(' ')
+	writer.WriteString(metricType)
+	writer.WriteByte('\n')
+}
+
+// labelName and extraName are ignored when empty
+func writeSample(writer *bufio.Writer, name string, labelName string, label string, extraName string, extraLabel string, value float64) {
+	writer.WriteString(name)
+	if labelName != "" || extraName != "" {
+		writer.WriteByte('{')
+		if labelName != "" {
+			writeLabel(writer, labelName, label)
+			if extraName != "" {
+				writer.WriteByte(',')
+			}
+		}
+		if extraName != "" {
+			writeLabel(writer, extraName, extraLabel)
+		}
+		writer.WriteByte('}')
+	}
+	writer.WriteByte(' ')
+	writer.WriteString(formatFloat(value))
+	writer.WriteByte('\n')
+}
+
+var labelEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func writeLabel(writer *bufio.Writer, name string, value string) {
+	writer.WriteString(name)
+	writer.WriteString("=\"")
+	labelEscaper.WriteString(writer, value)
+	writer.WriteByte('"')
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writer := bufio.NewWriter(w)
+	for _, metric := range metricRegistry {
+		metric.write(writer)
+	}
+	writer.Flush()
+}
@@ -0,0 +1,114 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"bufio"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func writeMetric(metric metricWriter) string {
+	var builder strings.Builder
+	writer := bufio.NewWriter(&builder)
+	metric.write(writer)
+	writer.Flush()
+	return builder.String()
+}
+
+func TestCounterWithoutLabel(t *testing.T) {
+	metric := &MetricVec{name: "test_total", help: "Test counter.", metricType: "counter", labelToValues: map[string]float64{"": 0}}
+	if got, want := writeMetric(metric), "# HELP test_total Test counter.\n# TYPE test_total counter\ntest_total 0\n"; got != want {
+		t.Errorf("unexpected output before increment :\n%s\nwant :\n%s", got, want)
+	}
+
+	metric.Inc("")
+	metric.Add("", 1.5)
+	if got, want := writeMetric(metric), "# HELP test_total Test counter.\n# TYPE test_total counter\ntest_total 2.5\n"; got != want {
+		t.Errorf("unexpected output :\n%s\nwant :\n%s", got, want)
+	}
+}
+
+func TestGaugeWithLabels(t *testing.T) {
+	metric := &MetricVec{name: "test_gauge", help: "Test gauge.", metricType: "gauge", labelName: "kind", labelToValues: map[string]float64{}}
+	metric.Set("b", 3)
+	metric.Set("a\"b\\c\nd", 2)
+	metric.Set("b", 4)
+
+	want := "# HELP test_gauge Test gauge.\n# TYPE test_gauge gauge\n" +
+		"test_gauge{kind=\"a\\\"b\\\\c\\nd\"} 2\n" +
+		"test_gauge{kind=\"b\"} 4\n"
+	if got := writeMetric(metric); got != want {
+		t.Errorf("unexpected output :\n%s\nwant :\n%s", got, want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	metric := &HistogramVec{name: "test_seconds", help: "Test histogram.", labelName: "feed", buckets: []float64{1, 5}, labelToValues: map[string]*histogram{}}
+	for _, value := range []float64{0.5, 1, 3, 10} {
+		metric.Observe("x", value)
+	}
+
+	// the buckets are cumulative and their upper bound is inclusive
+	want := "# HELP test_seconds Test histogram.\n# TYPE test_seconds histogram\n" +
+		"test_seconds_bucket{feed=\"x\",le=\"1\"} 2\n" +
+		"test_seconds_bucket{feed=\"x\",le=\"5\"} 3\n" +
+		"test_seconds_bucket{feed=\"x\",le=\"+Inf\"} 4\n" +
+		"test_seconds_sum{feed=\"x\"} 14.5\n" +
+		"test_seconds_count{feed=\"x\"} 4\n"
+	if got := writeMetric(metric); got != want {
+		t.Errorf("unexpected output :\n%s\nwant :\n%s", got, want)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	MetricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if contentType := recorder.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type : %s", contentType)
+	}
+	body := recorder.Body.String()
+	for _, expected := range []string{"# TYPE casiusbot_commands_total counter\n", "casiusbot_gateway_reconnects_total 0\n", "# TYPE casiusbot_rss_fetch_duration_seconds histogram\n"} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("missing %q in output :\n%s", expected, body)
+		}
+	}
+}
+
+func TestMessagesIsError(t *testing.T) {
+	msgs := Messages{
+		ErrGlobalCmd: "Problem with the {{cmd}} command", ErrGlobal: "Problem with the command",
+		ErrPartial: "Applied with {{numError}} error(s)", Ok: "Done",
+	}
+	for msg, want := range map[string]bool{
+		"Problem with the {{cmd}} command":   true,
+		"Problem with the count command":     true,
+		"Problem with the command":           true,
+		"Applied with 3 error(s)":            true,
+		"Applied with  error(s)":             false,
+		"Done":                               false,
+		"Problem with the count command too": false,
+	} {
+		if got := msgs.isError(msg); got != want {
+			t.Errorf("isError(%q) = %v, want %v", msg, got, want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package common
+
+import (
+	"slices"
+	"strings"
+)
+
+// NameResolver resolve a reference from the configuration, which could be a name or a snowflake id
+type NameResolver struct {
+	kind      string
+	idToName  map[string]string
+	nameToIds map[string][]string
+}
+
+// kind is used in problem messages (like "role" or "channel")
+func MakeNameResolver(kind string) NameResolver {
+	return NameResolver{kind: kind, idToName: map[string]string{}, nameToIds: map[string][]string{}}
+}
+
+func (r NameResolver) Add(id string, name string) {
+	r.idToName[id] = name
+	r.nameToIds[name] = append(r.nameToIds[name], id)
+}
+
+func (r NameResolver) Name(id string) string {
+	return r.idToName[id]
+}
+
+// return the id corresponding to ref, or an empty string and a problem description (the id take precedence over the name)
+func (r NameResolver) Resolve(ref string, confName string) (string, string) {
+	if _, ok := r.idToName[ref]; ok {
+		return ref, ""
+	}
+
+	switch ids := r.nameToIds[ref]; len(ids) {
+	case 0:
+		return "", "Unrecognized " + r.kind + " in " + confName + " : " + ref
+	case 1:
+		return ids[0], ""
+	default:
+		sortedIds := slices.Clone(ids)
+		slices.Sort(sortedIds)
+		return "", "Ambiguous " + r.kind + " name in " + confName + " : " + ref + " (use one of the ids : " + strings.Join(sortedIds, ", ") + ")"
+	}
+}
+
+// resolve all the refs, the problems are appended to the given ones
+func (r NameResolver) ResolveSet(refs []string, confName string, problems []string) (StringSet, []string) {
+	idSet := StringSet{}
+	for _, ref := range refs {
+		if id, problem := r.Resolve(ref, confName); problem == "" {
+			idSet[id] = Empty{}
+		} else {
+			problems = append(problems, problem)
+		}
+	}
+	return idSet, problems
+}
@@ -27,6 +27,8 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+
+	"github.com/dvaumoron/casiusbot/common"
 )
 
 var errCast = errors.New("failed to cast the retrieved result")
@@ -82,6 +84,8 @@ func (c DeepLClient) Translate(msg string) string {
 		log.Println("Failed to translate :", err)
 		return c.messageError
 	}
+	// only the translated characters are billed
+	common.DeepLCharacters.Add("", float64(msgSize))
 	return res
 }
 
@@ -119,6 +123,8 @@ func (c DeepLClient) checkUsage(size int) error {
 		return errCast
 	}
 
+	common.DeepLUsed.Set("", count)
+	common.DeepLRemaining.Set("", limit-count)
 	if int(limit-count) < size {
 		return errLimit
 	}
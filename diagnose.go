@@ -0,0 +1,238 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+const diagnoseFileName = "diagnose.txt"
+
+type diagnoseModule struct {
+	baseModule
+	diagnoseMsg   string
+	diagnoseOkMsg string
+}
+
+func (m *diagnoseModule) configure(b *bot) bool {
+	m.diagnoseMsg = b.config.GetString("MESSAGE_DIAGNOSE")
+	m.diagnoseOkMsg = b.config.GetString("MESSAGE_DIAGNOSE_OK")
+	if b.cmdConfig["DIAGNOSE"].Name != "" {
+		b.requireTarget(targetCmdChannel, cmdChannelProblem)
+	}
+	return true
+}
+
+func (m *diagnoseModule) register(b *bot) {
+	b.addAdminCmd(helpGroupPrefix, "DIAGNOSE", nil, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		diagnoseCmd(s, i, b.cmdChannelSender(), m.diagnoseMsg, m.diagnoseOkMsg, b.channelManager, b.syncProblems, b.infosHolder.Get())
+	})
+}
+
+func (m *diagnoseModule) start(b *bot) {
+	// startup diagnose only send a message on problem
+	go sendDiagnose(b.session, b.cmdChannelSender(), m.diagnoseMsg, m.diagnoseOkMsg, b.channelManager, b.syncProblems, b.infosHolder.Get(), false)
+}
+
+var guildPermissionNames = [...]struct {
+	permission int64
+	name       string
+}{
+	{permission: discordgo.PermissionManageRoles, name: "Manage Roles"},
+	{permission: discordgo.PermissionManageNicknames, name: "Manage Nicknames"},
+}
+
+var channelPermissionNames = [...]struct {
+	permission int64
+	name       string
+}{
+	{permission: discordgo.PermissionViewChannel, name: "View Channel"},
+	{permission: discordgo.PermissionSendMessages, name: "Send Messages"},
+	{permission: discordgo.PermissionAttachFiles, name: "Attach Files"},
+}
+
+func diagnoseCmd(s *discordgo.Session, i *discordgo.InteractionCreate, messageSender chan<- common.MultipartMessage, baseMsg string, okMsg string, channelManager common.ChannelSenderManager, syncProblems []string, infos common.GuildAndConfInfo) {
+	common.AuthorizedCmd(s, i, infos, func() string {
+		go sendDiagnose(s, messageSender, baseMsg, okMsg, channelManager, syncProblems, infos, true)
+		return infos.Msgs.Ok
+	})
+}
+
+// log the detected problems and send them with messageSender (when not nil), with the command synchronization ones,
+// if forceSend is false nothing is send when there is no problem
+func sendDiagnose(s *discordgo.Session, messageSender chan<- common.MultipartMessage, baseMsg string, okMsg string, channelManager common.ChannelSenderManager, syncProblems []string, infos common.GuildAndConfInfo, forceSend bool) {
+	auditEnabled := channelManager.GetTargetChannel(targetAuditChannel) != ""
+	problems := append(diagnose(s, channelManager.GetTargetChannels(), auditEnabled, infos), syncProblems...)
+	for _, problem := range problems {
+		log.Println("Diagnose :", problem)
+	}
+
+	if messageSender != nil {
+		if len(problems) == 0 {
+			if forceSend {
+				messageSender <- common.MultipartMessage{Message: okMsg}
+			}
+		} else {
+			messageSender <- common.MultipartMessage{
+				Message: baseMsg, FileName: diagnoseFileName, FileData: strings.Join(problems, "\n"), AllowMerge: true,
+			}
+		}
+	}
+}
+
+func diagnose(s *discordgo.Session, channelIds []string, auditEnabled bool, infos common.GuildAndConfInfo) []string {
+	guild, err := s.Guild(infos.GuildId)
+	if err != nil {
+		log.Println("Cannot retrieve the guild (2) :", err)
+		return []string{"Cannot retrieve the guild, check the GUILD_ID configuration"}
+	}
+
+	botId := s.State.User.ID
+	botMember, err := s.GuildMember(infos.GuildId, botId)
+	if err != nil {
+		log.Println("Cannot retrieve the bot member :", err)
+		return []string{"Cannot retrieve the bot as a member of the guild, check that the bot is invited in the guild"}
+	}
+
+	roleIdToRole := make(map[string]*discordgo.Role, len(guild.Roles))
+	for _, role := range guild.Roles {
+		roleIdToRole[role.ID] = role
+	}
+
+	var problems []string
+	botPermissions := int64(0)
+	if everyoneRole := roleIdToRole[guild.ID]; everyoneRole != nil {
+		botPermissions = everyoneRole.Permissions
+	}
+	var botTopRole *discordgo.Role
+	for _, roleId := range botMember.Roles {
+		if role := roleIdToRole[roleId]; role != nil {
+			botPermissions |= role.Permissions
+			if botTopRole == nil || role.Position > botTopRole.Position {
+				botTopRole = role
+			}
+		}
+	}
+	if botTopRole == nil {
+		return []string{"The bot has no role, add it a role with the Manage Roles and Manage Nicknames permissions"}
+	}
+
+	if botPermissions&discordgo.PermissionAdministrator == 0 {
+		for _, permissionName := range guildPermissionNames {
+			if botPermissions&permissionName.permission == 0 {
+				problems = append(problems, "The bot lacks the "+permissionName.name+" permission, grant it to the role "+botTopRole.Name)
+			}
+		}
+	}
+
+	// invites are needed to choose the joining role
+	if len(infos.InviteToRoleId) != 0 && botPermissions&(discordgo.PermissionAdministrator|discordgo.PermissionManageServer) == 0 {
+		problems = append(problems, "The bot lacks the Manage Server permission needed to read invites, grant it to the role "+botTopRole.Name)
+	}
+
+	// the audit log is needed to find the author of the member changes
+	if auditEnabled && botPermissions&(discordgo.PermissionAdministrator|discordgo.PermissionViewAuditLogs) == 0 {
+		problems = append(problems, "The bot lacks the View Audit Log permission needed to find who changed a member, grant it to the role "+botTopRole.Name)
+	}
+
+	managedRoleIds := common.StringSet{}
+	for roleId := range infos.RoleIdToPrefix {
+		managedRoleIds[roleId] = common.Empty{}
+	}
+	for roleId := range infos.ForbiddenRoleIds {
+		managedRoleIds[roleId] = common.Empty{}
+	}
+	for _, roleId := range infos.InviteToRoleId {
+		managedRoleIds[roleId] = common.Empty{}
+	}
+	// could be empty when the role is not recognized
+	for _, roleId := range [...]string{infos.DefaultRoleId, infos.JoiningRoleId, infos.QuarantineRoleId} {
+		if roleId != "" {
+			managedRoleIds[roleId] = common.Empty{}
+		}
+	}
+
+	managedRoles := make([]*discordgo.Role, 0, len(managedRoleIds))
+	for roleId := range managedRoleIds {
+		if role := roleIdToRole[roleId]; role == nil {
+			problems = append(problems, "The managed role "+roleId+" does not exist anymore, update the configuration")
+		} else {
+			managedRoles = append(managedRoles, role)
+		}
+	}
+	slices.SortFunc(managedRoles, cmpRoleNameAsc)
+	for _, role := range managedRoles {
+		if role.Position >= botTopRole.Position {
+			problems = append(problems, "The managed role "+role.Name+" is not below the bot role "+botTopRole.Name+", move "+botTopRole.Name+" above it in the role list")
+		}
+	}
+
+	for _, channelId := range channelIds {
+		channelName := channelId
+		if channel, err := s.Channel(channelId); err == nil {
+			channelName = channel.Name
+		}
+
+		permissions, err := s.UserChannelPermissions(botId, channelId)
+		if err != nil {
+			log.Println("Cannot compute the bot permissions on channel :", err)
+			problems = append(problems, "Cannot check the permissions on the channel "+channelName+", check that it still exists")
+			continue
+		}
+		for _, permissionName := range channelPermissionNames {
+			if permissions&permissionName.permission == 0 {
+				problems = append(problems, "The bot lacks the "+permissionName.name+" permission on the channel "+channelName+", grant it to the role "+botTopRole.Name+" in the channel settings")
+			}
+		}
+	}
+
+	guildMembers, err := s.GuildMembers(infos.GuildId, "", common.MemberCallLimit)
+	if err != nil {
+		log.Println("Cannot retrieve guild members (5) :", err)
+		return append(problems, "Cannot retrieve the guild members, enable the Server Members Intent of the bot")
+	}
+
+	for _, member := range guildMembers {
+		userId := member.User.ID
+		if userId == botId || common.IdInSet(member.Roles, infos.IgnoredRoleIds) {
+			continue
+		}
+
+		if userId == infos.OwnerId {
+			problems = append(problems, "The member "+common.ExtractNick(member)+" is the guild owner and can never be renamed by a bot, change its nickname manually")
+			continue
+		}
+		for _, roleId := range member.Roles {
+			if role := roleIdToRole[roleId]; role != nil && role.Position >= botTopRole.Position {
+				problems = append(problems, "The member "+common.ExtractNick(member)+" has the role "+role.Name+" which is not below the bot role "+botTopRole.Name+", so it can never be renamed, move "+botTopRole.Name+" above it or add it to IGNORED_ROLES")
+				break
+			}
+		}
+	}
+	return problems
+}
+
+func cmpRoleNameAsc(a *discordgo.Role, b *discordgo.Role) int {
+	return strings.Compare(a.Name, b.Name)
+}
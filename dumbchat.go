@@ -21,7 +21,9 @@ package main
 import (
 	"encoding/json"
 	"log"
+	"maps"
 	"os"
+	"slices"
 	"strings"
 	"sync"
 
@@ -31,10 +33,65 @@ import (
 
 const defaultKey = "default"
 
-func manageChatResponse(u *discordgo.MessageCreate, botId string, channelManager common.ChannelSenderManager, keywordToResponse map[string]string, keywordToResponseMutex *sync.RWMutex) {
+// chatModule answer the messages mentioning the bot with the registered rules
+// (the rules are not saved without CHAT_RESPONSES_PATH)
+type chatModule struct {
+	baseModule
+}
+
+func (chatModule) configure(b *bot) bool {
+	chatReponsePath, keywordToResponse := b.config.GetChatResponsesConfig()
+	b.chat = &chatRules{path: chatReponsePath, keywordToResponse: keywordToResponse}
+	return true
+}
+
+func (chatModule) register(b *bot) {
+	config := b.config
+	chat := b.chat
+
+	botId := b.session.State.Application.ID
+	b.session.AddHandler(func(s *discordgo.Session, u *discordgo.MessageCreate) {
+		manageChatResponse(u, botId, b.channelManager, chat)
+	})
+
+	stringParams := []*discordgo.ApplicationCommandOption{{
+		Type: discordgo.ApplicationCommandOptionString, Name: "keyword",
+		Description: config.Require("PARAMETER_DESCRIPTION_REGISTER_CHAT_RULE_CMD_1"), Required: true,
+	}, {
+		Type: discordgo.ApplicationCommandOptionString, Name: "response",
+		Description: config.Require("PARAMETER_DESCRIPTION_REGISTER_CHAT_RULE_CMD_2"),
+	}}
+	b.addAdminCmd(helpGroupChat, "REGISTER_CHAT_RULE", stringParams, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		registerChatResponseCmd(s, i, chat, b.infosHolder.Get())
+	})
+	baseDisplayChatRuleMsg := config.GetString("MESSAGE_CMD_DISPLAY")
+	b.addAdminCmd(helpGroupChat, "DISPLAY_CHAT_RULE", nil, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		displayChatResponseCmd(s, i, baseDisplayChatRuleMsg, chat, b.infosHolder.Get())
+	})
+
+	if addChatRuleConf := b.menuConfig["ADD_CHAT_RULE"]; addChatRuleConf.Name != "" {
+		keywordLabel := config.Require("LABEL_CHAT_RULE_KEYWORD")
+		responseLabel := config.Require("LABEL_CHAT_RULE_RESPONSE")
+		addChatRuleName := b.addMenu(discordgo.MessageApplicationCommand, addChatRuleConf.WithDefaultPermission(b.adminPermission), func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			addChatRuleMenu(s, i, keywordLabel, responseLabel, b.infosHolder.Get())
+		})
+		b.execComponents[chatRuleModalId] = func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			chatRuleModal(s, i, addChatRuleName, chat, b.infosHolder.Get())
+		}
+	}
+}
+
+// chatRules hold the keyword to response rules, shared with the admin dashboard
+type chatRules struct {
+	path              string
+	keywordToResponse map[string]string
+	mutex             sync.RWMutex
+}
+
+func manageChatResponse(u *discordgo.MessageCreate, botId string, channelManager common.ChannelSenderManager, chat *chatRules) {
 	for _, user := range u.Mentions {
 		if user.ID == botId {
-			if response, ok := chooseResponse(u.Content, keywordToResponse, keywordToResponseMutex); ok {
+			if response, ok := chat.choose(u.Content); ok {
 				channelId := u.ChannelID
 				channelManager.AddChannel(channelId)
 				channelManager.Get(channelId) <- common.MultipartMessage{Message: response}
@@ -44,57 +101,78 @@ func manageChatResponse(u *discordgo.MessageCreate, botId string, channelManager
 	}
 }
 
-func chooseResponse(content string, keywordToResponse map[string]string, keywordToResponseMutex *sync.RWMutex) (string, bool) {
+func (r *chatRules) choose(content string) (string, bool) {
 	contentLower := strings.ToLower(content)
 
-	keywordToResponseMutex.RLock()
-	defer keywordToResponseMutex.RUnlock()
-	for keyword, response := range keywordToResponse {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for keyword, response := range r.keywordToResponse {
 		if strings.Contains(contentLower, keyword) {
 			return response, true
 		}
 	}
-	response, ok := keywordToResponse[defaultKey]
+	response, ok := r.keywordToResponse[defaultKey]
 	return response, ok
 }
 
-func registerChatResponseCmd(s *discordgo.Session, i *discordgo.InteractionCreate, chatReponsePath string, keywordToResponse map[string]string, keywordToResponseMutex *sync.RWMutex, infos common.GuildAndConfInfo) {
+func registerChatResponseCmd(s *discordgo.Session, i *discordgo.InteractionCreate, chat *chatRules, infos common.GuildAndConfInfo) {
 	common.AuthorizedCmd(s, i, infos, func() string {
 		options := i.ApplicationCommandData().Options
 		if optionsLen := len(options); optionsLen != 0 {
-			keyword := strings.ToLower(options[0].StringValue())
 			response := ""
 			if optionsLen > 1 {
-				response = strings.TrimSpace(options[1].StringValue())
-			}
-
-			keywordToResponseMutex.Lock()
-			if response == "" {
-				delete(keywordToResponse, keyword)
-			} else {
-				keywordToResponse[keyword] = response
+				response = options[1].StringValue()
 			}
-			keywordToResponseMutex.Unlock()
-
-			data, err := json.Marshal(keywordToResponse)
-			if err == nil {
-				if err = os.WriteFile(chatReponsePath, data, 0644); err == nil {
-					return infos.Msgs.Ok
-				} else {
-					log.Println("Fail to save chat responses data :", err)
-				}
-			} else {
-				log.Println("Fail to marshal chat responses data :", err)
+			if chat.register(options[0].StringValue(), response) {
+				return infos.Msgs.Ok
 			}
 		}
 		return infos.Msgs.ErrGlobal
 	})
 }
 
-func displayChatResponseCmd(s *discordgo.Session, i *discordgo.InteractionCreate, baseMsg string, keywordToResponse map[string]string, keywordToResponseMutex *sync.RWMutex, infos common.GuildAndConfInfo) {
+// an empty response delete the rule, return true when the rules are saved
+func (r *chatRules) register(keyword string, response string) bool {
+	keyword = strings.ToLower(keyword)
+	response = strings.TrimSpace(response)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if response == "" {
+		delete(r.keywordToResponse, keyword)
+	} else {
+		r.keywordToResponse[keyword] = response
+	}
+
+	data, err := json.Marshal(r.keywordToResponse)
+	if err == nil {
+		if err = os.WriteFile(r.path, data, 0644); err == nil {
+			return true
+		} else {
+			log.Println("Fail to save chat responses data :", err)
+		}
+	} else {
+		log.Println("Fail to marshal chat responses data :", err)
+	}
+	return false
+}
+
+// return the keyword and response pairs, sorted by keyword
+func (r *chatRules) list() [][2]string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	rules := make([][2]string, 0, len(r.keywordToResponse))
+	for _, keyword := range slices.Sorted(maps.Keys(r.keywordToResponse)) {
+		rules = append(rules, [2]string{keyword, r.keywordToResponse[keyword]})
+	}
+	return rules
+}
+
+func displayChatResponseCmd(s *discordgo.Session, i *discordgo.InteractionCreate, baseMsg string, chat *chatRules, infos common.GuildAndConfInfo) {
 	common.AuthorizedCmd(s, i, infos, func() string {
-		keywordToResponseMutex.RLock()
-		defer keywordToResponseMutex.RUnlock()
-		return common.BuildMsgWithNameValueList(baseMsg, keywordToResponse)
+		chat.mutex.RLock()
+		defer chat.mutex.RUnlock()
+		return common.BuildMsgWithNameValueList(baseMsg, chat.keywordToResponse)
 	})
 }
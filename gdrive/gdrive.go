@@ -160,7 +160,7 @@ func (config *DriveConfig) sendRefreshUrl(errorMsgSender chan<- common.Multipart
 }
 
 func (config *DriveConfig) DriveTokenCmd(s *discordgo.Session, i *discordgo.InteractionCreate, infos common.GuildAndConfInfo) {
-	common.AuthorizedCmd(s, i, infos, func() string {
+	common.AuthorizedDeferredCmd(s, i, infos, func() string {
 		if options := i.ApplicationCommandData().Options; len(options) != 0 {
 			if err := config.saveToken(options[0].StringValue()); err == nil {
 				return infos.Msgs.Ok
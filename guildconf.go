@@ -0,0 +1,366 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+const (
+	targetReminderChannel   = "TARGET_REMINDER_CHANNEL"
+	targetPrefixChannel     = "TARGET_PREFIX_CHANNEL"
+	targetCmdChannel        = "TARGET_CMD_CHANNEL"
+	targetNewsChannel       = "TARGET_NEWS_CHANNEL"
+	targetActivitiesChannel = "TARGET_ACTIVITIES_CHANNEL"
+	targetWelcomeChannel    = "TARGET_WELCOME_CHANNEL"
+	targetAuditChannel      = "TARGET_AUDIT_CHANNEL"
+)
+
+// roleConf keep the role references (name or id) from the configuration,
+// allowing to rebuild the GuildAndConfInfo when the guild roles change
+type roleConf struct {
+	guildId          string
+	roleRefToPrefix  map[string]string
+	prefixes         []string
+	cmdRoleDescs     []common.CmdRoleDesc
+	specialRoles     []string
+	authorizedRoles  []string
+	forbiddenRoles   []string
+	ignoredRoles     []string
+	countFilterRoles []string
+	defaultRole      string
+	joiningRole      string
+	quarantineRole   string
+	inviteToRole     map[string]string
+	cmdToConf        map[string]common.CmdConf // only commands with roles or users
+	ephemeralCmds    common.StringSet
+	countFilterType  string
+	msgs             common.Messages // ErrUnauthorized is completed with the prefix rules
+}
+
+func readRoleConf(config common.Config, guildId string, msgs common.Messages, cmdConfigs ...map[string]common.CmdConf) roleConf {
+	roleRefToPrefix, prefixes, cmdRoleDescs, specialRoles := config.GetPrefixConfig()
+
+	countFilterType := config.GetString("COUNT_FILTER_TYPE")
+	switch countFilterType {
+	case "list", "prefix", "cmdPrefix", "":
+	default:
+		panic("COUNT_FILTER_TYPE must be empty or one of : \"list\", \"prefix\", \"cmdPrefix\"")
+	}
+
+	inviteToRole := map[string]string{}
+	for _, rule := range config.GetSlice("JOINING_INVITE_RULES") {
+		casted, ok := rule.(map[string]any)
+		if !ok {
+			panic("Malformed joining invite rule")
+		}
+
+		invite, _ := casted["INVITE"].(string)
+		role, _ := casted["ROLE"].(string)
+		if invite == "" || role == "" {
+			panic("Joining invite rule without INVITE or ROLE")
+		}
+		inviteToRole[invite] = role
+	}
+
+	ephemeralCmds := common.StringSet{}
+	if config.GetBool("EPHEMERAL_ROLE_CMDS") {
+		for _, cmdRoleDesc := range cmdRoleDescs {
+			ephemeralCmds[cmdRoleDesc.Cmd] = common.Empty{}
+		}
+	}
+
+	cmdToConf := map[string]common.CmdConf{}
+	// the menu config could follow the command one
+	for _, cmdConfig := range cmdConfigs {
+		for cmdKey, cmdConf := range cmdConfig {
+			cmdNames := []string{cmdConf.Name}
+			if cmdKey == "RESET_GROUP" {
+				// the name is a template
+				cmdNames = cmdNames[:0]
+				for _, cmdRoleDesc := range cmdRoleDescs {
+					if group := cmdRoleDesc.Group; group != "" {
+						cmdNames = append(cmdNames, strings.ReplaceAll(cmdConf.Name, common.GroupPlaceHolder, group))
+					}
+				}
+			}
+
+			for _, cmdName := range cmdNames {
+				if cmdConf.Ephemeral {
+					ephemeralCmds[cmdName] = common.Empty{}
+				}
+				if len(cmdConf.Roles) != 0 || len(cmdConf.Users) != 0 {
+					cmdToConf[cmdName] = cmdConf
+				}
+			}
+		}
+	}
+
+	return roleConf{
+		guildId: guildId, roleRefToPrefix: roleRefToPrefix,
+		prefixes: prefixes, cmdRoleDescs: cmdRoleDescs,
+		specialRoles: specialRoles, authorizedRoles: config.GetStringSlice("AUTHORIZED_ROLES"),
+		forbiddenRoles: config.GetStringSlice("FORBIDDEN_ROLES"), ignoredRoles: config.GetStringSlice("IGNORED_ROLES"),
+		countFilterRoles: config.GetStringSlice("COUNT_FILTER_ROLES"), defaultRole: config.Require("DEFAULT_ROLE"),
+		joiningRole: config.GetString("JOINING_ROLE"), inviteToRole: inviteToRole, cmdToConf: cmdToConf, ephemeralCmds: ephemeralCmds,
+		quarantineRole: config.GetString("QUARANTINE_ROLE"), countFilterType: countFilterType, msgs: msgs,
+	}
+}
+
+// build the GuildAndConfInfo from the current guild roles,
+// the returned problems list the configured references which are not recognized or ambiguous
+func (rc roleConf) buildInfos(ownerId string, guildRoles []*discordgo.Role) (common.GuildAndConfInfo, []string) {
+	resolver := common.MakeNameResolver("role")
+	roleIdToDisplayName := make(map[string]string, len(guildRoles))
+	for _, guildRole := range guildRoles {
+		resolver.Add(guildRole.ID, guildRole.Name)
+		roleIdToDisplayName[guildRole.ID] = guildRole.Name
+	}
+
+	var problems []string
+	prefixRoleIds := common.StringSet{}
+	roleIdToPrefix := map[string]string{}
+	roleNameToPrefix := map[string]string{}
+	for roleRef, prefix := range rc.roleRefToPrefix {
+		if id, problem := resolver.Resolve(roleRef, "PREFIX_RULES"); problem == "" {
+			name := resolver.Name(id)
+			roleIdToPrefix[id] = prefix
+			roleNameToPrefix[name] = prefix
+			prefixRoleIds[id] = common.Empty{}
+			var buffer strings.Builder
+			buffer.WriteString(name)
+			buffer.WriteByte(' ')
+			buffer.WriteString(prefix)
+			roleIdToDisplayName[id] = buffer.String()
+		} else {
+			problems = append(problems, problem)
+		}
+	}
+
+	cmdRoleIds := common.StringSet{}
+	cmdToRoleId := make(map[string]string, len(rc.cmdRoleDescs))
+	roleIdToGroup := make(map[string]string, len(rc.cmdRoleDescs))
+	for _, cmdRoleDesc := range rc.cmdRoleDescs {
+		// problem already reported with the prefix
+		if roleId, _ := resolver.Resolve(cmdRoleDesc.Name, "PREFIX_RULES"); roleId != "" {
+			cmdRoleIds[roleId] = common.Empty{}
+			cmdToRoleId[cmdRoleDesc.Cmd] = roleId
+			if group := cmdRoleDesc.Group; group != "" {
+				roleIdToGroup[roleId] = group
+			}
+		}
+	}
+
+	specialRoleIds := common.StringSet{}
+	for _, roleRef := range rc.specialRoles {
+		// problem already reported with the prefix
+		if roleId, _ := resolver.Resolve(roleRef, "PREFIX_RULES"); roleId != "" {
+			specialRoleIds[roleId] = common.Empty{}
+		}
+	}
+
+	authorizedRoleIds, problems := resolver.ResolveSet(rc.authorizedRoles, "AUTHORIZED_ROLES", problems)
+	forbiddenRoleIds, problems := resolver.ResolveSet(rc.forbiddenRoles, "FORBIDDEN_ROLES", problems)
+	ignoredRoleIds, problems := resolver.ResolveSet(rc.ignoredRoles, "IGNORED_ROLES", problems)
+
+	defaultRoleId, problem := resolver.Resolve(rc.defaultRole, "DEFAULT_ROLE")
+	if problem != "" {
+		problems = append(problems, problem)
+	}
+
+	joiningRoleId := ""
+	if rc.joiningRole != "" {
+		if joiningRoleId, problem = resolver.Resolve(rc.joiningRole, "JOINING_ROLE"); problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+
+	quarantineRoleId := ""
+	if rc.quarantineRole != "" {
+		if quarantineRoleId, problem = resolver.Resolve(rc.quarantineRole, "QUARANTINE_ROLE"); problem == "" {
+			// the prefix rules are not applied on members in quarantine
+			ignoredRoleIds[quarantineRoleId] = common.Empty{}
+		} else {
+			problems = append(problems, problem)
+		}
+	}
+
+	inviteToRoleId := make(map[string]string, len(rc.inviteToRole))
+	for invite, roleRef := range rc.inviteToRole {
+		if roleId, problem := resolver.Resolve(roleRef, "JOINING_INVITE_RULES"); problem == "" {
+			inviteToRoleId[invite] = roleId
+		} else {
+			problems = append(problems, problem)
+		}
+	}
+
+	cmdToAccess := make(map[string]common.CmdAccess, len(rc.cmdToConf))
+	for cmd, cmdConf := range rc.cmdToConf {
+		var roleIds common.StringSet
+		roleIds, problems = resolver.ResolveSet(cmdConf.Roles, "CMDS ("+cmd+")", problems)
+		userIds := make(common.StringSet, len(cmdConf.Users))
+		for _, userId := range cmdConf.Users {
+			userIds[userId] = common.Empty{}
+		}
+		cmdToAccess[cmd] = common.CmdAccess{RoleIds: roleIds, UserIds: userIds}
+	}
+
+	// merge the two categories
+	forbiddenAndIgnoredRoleIds := common.StringSet{}
+	for roleId := range forbiddenRoleIds {
+		forbiddenAndIgnoredRoleIds[roleId] = common.Empty{}
+	}
+	for roleId := range ignoredRoleIds {
+		forbiddenAndIgnoredRoleIds[roleId] = common.Empty{}
+	}
+
+	var countFilterRoleIds common.StringSet
+	switch rc.countFilterType {
+	case "list":
+		countFilterRoleIds, problems = resolver.ResolveSet(rc.countFilterRoles, "COUNT_FILTER_ROLES", problems)
+	case "prefix":
+		countFilterRoleIds = prefixRoleIds
+	case "cmdPrefix":
+		countFilterRoleIds = cmdRoleIds
+	}
+	// a nil or empty countFilterRoleIds disable filtering
+
+	msgs := rc.msgs
+	// the message display the current role names
+	msgs.ErrUnauthorized = common.BuildMsgWithNameValueList(msgs.ErrUnauthorized, roleNameToPrefix)
+
+	slices.Sort(problems)
+	return common.GuildAndConfInfo{
+		GuildId: rc.guildId, OwnerId: ownerId, DefaultRoleId: defaultRoleId, JoiningRoleId: joiningRoleId,
+		AuthorizedRoleIds: authorizedRoleIds, ForbiddenRoleIds: forbiddenRoleIds, IgnoredRoleIds: ignoredRoleIds,
+		ForbiddenAndIgnoredRoleIds: forbiddenAndIgnoredRoleIds, CmdRoleIds: cmdRoleIds, SpecialRoleIds: specialRoleIds,
+		CountFilterRoleIds: countFilterRoleIds, RoleIdToPrefix: roleIdToPrefix, Prefixes: rc.prefixes,
+		RoleIdToDisplayName: roleIdToDisplayName, CmdToRoleId: cmdToRoleId, RoleIdToGroup: roleIdToGroup,
+		InviteToRoleId: inviteToRoleId, QuarantineRoleId: quarantineRoleId, CmdToAccess: cmdToAccess, EphemeralCmds: rc.ephemeralCmds, Msgs: msgs,
+	}, problems
+}
+
+// resolve the configured channel references (by target) among the text and news channels,
+// the returned problems list the configured references which are not recognized or ambiguous
+func resolveChannels(targetToRef map[string]string, guildChannels []*discordgo.Channel) (map[string]string, []string) {
+	resolver := common.MakeNameResolver("channel")
+	for _, channel := range guildChannels {
+		// a category or a voice channel can share its name with a text channel
+		if channel.Type == discordgo.ChannelTypeGuildText || channel.Type == discordgo.ChannelTypeGuildNews {
+			resolver.Add(channel.ID, channel.Name)
+		}
+	}
+
+	var problems []string
+	targetToId := make(map[string]string, len(targetToRef))
+	for target, ref := range targetToRef {
+		if ref != "" {
+			if id, problem := resolver.Resolve(ref, target); problem == "" {
+				targetToId[target] = id
+			} else {
+				problems = append(problems, problem)
+			}
+		}
+	}
+	slices.Sort(problems)
+	return targetToId, problems
+}
+
+// guildConfUpdater rebuild the GuildAndConfInfo and the channel targets when the guild roles or channels change
+type guildConfUpdater struct {
+	rc              roleConf
+	targetToRef     map[string]string
+	infosHolder     *common.InfosHolder
+	manager         common.ChannelSenderManager
+	warningMsg      string
+	roleProblems    []string
+	channelProblems []string
+	mutex           sync.Mutex
+}
+
+// the guild roles are retrieved under the lock, so the last event always install the last roles
+func (u *guildConfUpdater) updateRoles(s *discordgo.Session) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	guildRoles, err := s.GuildRoles(u.rc.guildId)
+	if err != nil {
+		log.Println("Cannot retrieve the guild roles :", err)
+		return
+	}
+
+	infos, problems := u.rc.buildInfos(u.infosHolder.Get().OwnerId, guildRoles)
+	u.infosHolder.Set(infos)
+	u.roleProblems = u.warnNew(u.roleProblems, problems)
+}
+
+// apply the messages changed at runtime, the infos are rebuilt with the current guild roles
+func (u *guildConfUpdater) updateMessages(s *discordgo.Session, msgs common.Messages) {
+	u.mutex.Lock()
+	u.rc.msgs = msgs
+	u.mutex.Unlock()
+
+	u.updateRoles(s)
+}
+
+// same as updateRoles, the guild channels are retrieved under the lock
+func (u *guildConfUpdater) updateChannels(s *discordgo.Session) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	guildChannels, err := s.GuildChannels(u.rc.guildId)
+	if err != nil {
+		log.Println("Cannot retrieve the guild channels (2) :", err)
+		return
+	}
+
+	targetToId, problems := resolveChannels(u.targetToRef, guildChannels)
+	for target, ref := range u.targetToRef {
+		if ref != "" {
+			u.manager.SetTarget(target, targetToId[target])
+		}
+	}
+	u.channelProblems = u.warnNew(u.channelProblems, problems)
+}
+
+// log and send a warning for the problems which were not already reported
+func (u *guildConfUpdater) warnNew(previous []string, problems []string) []string {
+	newProblems := make([]string, 0, len(problems))
+	for _, problem := range problems {
+		if !slices.Contains(previous, problem) {
+			log.Println("Configuration warning :", problem)
+			newProblems = append(newProblems, problem)
+		}
+	}
+
+	if len(newProblems) != 0 {
+		if cmdChannelId := u.manager.GetTargetChannel(targetCmdChannel); cmdChannelId != "" {
+			u.manager.GetTarget(targetCmdChannel) <- common.MultipartMessage{
+				Message: u.warningMsg, FileName: "warning.txt", FileData: strings.Join(newProblems, "\n"), AllowMerge: true,
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,138 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// a loop is stalled without tick during two intervals and this delay
+	loopStallGrace = time.Minute
+	// Discord ask for a heartbeat every 41.25 seconds
+	heartbeatAckMaxAge = 2 * time.Minute
+)
+
+type loopState struct {
+	interval time.Duration
+	lastTick time.Time
+}
+
+// loopMonitor record the last tick of the background loops
+type loopMonitor struct {
+	nameToState map[string]*loopState
+	mutex       sync.Mutex
+}
+
+func makeLoopMonitor() *loopMonitor {
+	return &loopMonitor{nameToState: map[string]*loopState{}}
+}
+
+// return the function to call at the end of each tick of the loop
+func (m *loopMonitor) register(name string, interval time.Duration) func() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.nameToState[name] = &loopState{interval: interval, lastTick: time.Now()}
+	return func() {
+		m.tick(name)
+	}
+}
+
+// for a loop which end before the shutdown
+func (m *loopMonitor) unregister(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.nameToState, name)
+}
+
+func (m *loopMonitor) tick(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if state, ok := m.nameToState[name]; ok {
+		state.lastTick = time.Now()
+	}
+}
+
+func (m *loopMonitor) stalled(now time.Time) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var names []string
+	for name, state := range m.nameToState {
+		if now.Sub(state.lastTick) > 2*state.interval+loopStallGrace {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// healthModule add /healthz and /readyz to the HTTP server
+type healthModule struct {
+	baseModule
+}
+
+func (healthModule) configure(b *bot) bool {
+	return b.mux != nil
+}
+
+func (healthModule) register(b *bot) {
+	b.mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeProblems(w, b.healthProblems())
+	})
+	b.mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		var problems []string
+		if !b.ready.Load() {
+			problems = append(problems, "not ready")
+		}
+		writeProblems(w, problems)
+	})
+}
+
+func (b *bot) healthProblems() []string {
+	var problems []string
+	b.session.RLock()
+	dataReady, lastHeartbeatAck := b.session.DataReady, b.session.LastHeartbeatAck
+	b.session.RUnlock()
+
+	now := time.Now()
+	if !dataReady {
+		problems = append(problems, "gateway not connected")
+	} else if age := now.Sub(lastHeartbeatAck); age > heartbeatAckMaxAge {
+		problems = append(problems, "gateway heartbeat not acknowledged since "+age.Round(time.Second).String())
+	}
+	for _, name := range b.loops.stalled(now) {
+		problems = append(problems, "stalled loop : "+name)
+	}
+	return problems
+}
+
+func writeProblems(w http.ResponseWriter, problems []string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) != 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(strings.Join(problems, "\n")))
+		return
+	}
+	w.Write([]byte("ok"))
+}
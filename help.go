@@ -0,0 +1,242 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+const (
+	helpSelectId = "casiusbot-help-select"
+
+	helpGroupRoles    = "ROLES"
+	helpGroupPrefix   = "PREFIX"
+	helpGroupMembers  = "MEMBERS"
+	helpGroupSnapshot = "SNAPSHOT"
+	helpGroupActivity = "ACTIVITY"
+	helpGroupChat     = "CHAT"
+	helpGroupSchedule = "SCHEDULE"
+	helpGroupOther    = "OTHER"
+
+	// max number of options in a select menu
+	selectOptionLimit = 25
+	// max size of a message content
+	messageLimit = 2000
+)
+
+var helpGroupOrder = []string{
+	helpGroupRoles, helpGroupPrefix, helpGroupMembers, helpGroupSnapshot,
+	helpGroupActivity, helpGroupChat, helpGroupSchedule, helpGroupOther,
+}
+
+// helpModule must be declared last to be built from all the other commands
+type helpModule struct {
+	baseModule
+}
+
+func (helpModule) configure(b *bot) bool {
+	return b.cmdConfig["HELP"].Name != ""
+}
+
+func (helpModule) register(b *bot) {
+	// the help command is listed in its own index
+	var help *helpIndex
+	b.addPublicCmd(helpGroupOther, b.cmdConfig["HELP"], nil, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		help.helpCmd(s, i)
+	})
+	help = makeHelpIndex(b.config, &b.infosHolder, b.cmds, b.cmdToHelpGroup, b.publicCmds)
+	b.execComponents[helpSelectId] = help.selectCmd
+}
+
+type helpCmd struct {
+	cmd    *discordgo.ApplicationCommand
+	group  string
+	public bool
+}
+
+// helpIndex describe the registered commands, grouped by feature
+type helpIndex struct {
+	headerMsg     string
+	selectLabel   string
+	prefixLabel   string
+	requiredLabel string
+	groupTitles   map[string]string
+	infosHolder   *common.InfosHolder
+	cmds          []helpCmd
+	nameToCmd     map[string]helpCmd
+}
+
+// commands without group are in the other group, public commands are usable by everyone (role commands are always public)
+func makeHelpIndex(config common.Config, infosHolder *common.InfosHolder, cmds []*discordgo.ApplicationCommand, cmdToGroup map[string]string, publicCmds common.StringSet) *helpIndex {
+	groupTitles := make(map[string]string, len(helpGroupOrder))
+	for _, group := range helpGroupOrder {
+		if groupTitles[group] = config.GetString("HELP_GROUP_" + group); groupTitles[group] == "" {
+			groupTitles[group] = group
+		}
+	}
+
+	helpCmds := make([]helpCmd, 0, len(cmds))
+	nameToCmd := make(map[string]helpCmd, len(cmds))
+	for _, cmd := range cmds {
+		if cmd.Type != 0 && cmd.Type != discordgo.ChatApplicationCommand {
+			// context menus are not listed
+			continue
+		}
+
+		group := cmdToGroup[cmd.Name]
+		if group == "" {
+			group = helpGroupOther
+		}
+		_, public := publicCmds[cmd.Name]
+		current := helpCmd{cmd: cmd, group: group, public: public}
+		helpCmds = append(helpCmds, current)
+		nameToCmd[cmd.Name] = current
+	}
+	slices.SortFunc(helpCmds, cmpHelpCmd)
+
+	return &helpIndex{
+		headerMsg: config.GetString("MESSAGE_HELP"), selectLabel: config.GetString("LABEL_HELP_SELECT"),
+		prefixLabel: config.GetString("LABEL_HELP_PREFIX"), requiredLabel: config.GetString("LABEL_HELP_REQUIRED"),
+		groupTitles: groupTitles, infosHolder: infosHolder, cmds: helpCmds, nameToCmd: nameToCmd,
+	}
+}
+
+func cmpHelpCmd(a helpCmd, b helpCmd) int {
+	if res := cmp.Compare(slices.Index(helpGroupOrder, a.group), slices.Index(helpGroupOrder, b.group)); res != 0 {
+		return res
+	}
+	return cmp.Compare(a.cmd.Name, b.cmd.Name)
+}
+
+func (h *helpIndex) usable(member *discordgo.Member, current helpCmd, infos common.GuildAndConfInfo) bool {
+	if _, ok := infos.CmdToRoleId[current.cmd.Name]; ok {
+		return !common.IdInSet(member.Roles, infos.ForbiddenRoleIds)
+	}
+	if current.public {
+		return infos.AuthorizedPublicMember(member, current.cmd.Name)
+	}
+	return infos.AuthorizedMember(member, current.cmd.Name)
+}
+
+func (h *helpIndex) helpCmd(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	infos := h.infosHolder.Get()
+	var buffer strings.Builder
+	buffer.WriteString(h.headerMsg)
+	var selectOptions []discordgo.SelectMenuOption
+	previousGroup := ""
+	for _, current := range h.cmds {
+		if !h.usable(i.Member, current, infos) {
+			continue
+		}
+
+		var line strings.Builder
+		if current.group != previousGroup {
+			previousGroup = current.group
+			line.WriteString("\n**")
+			line.WriteString(h.groupTitles[current.group])
+			line.WriteString("**")
+		}
+		line.WriteString("\n/")
+		line.WriteString(current.cmd.Name)
+		line.WriteString(" : ")
+		line.WriteString(current.cmd.Description)
+		// the end of a too long list is only in the select menu
+		if buffer.Len()+line.Len() <= messageLimit {
+			buffer.WriteString(line.String())
+		}
+
+		if len(selectOptions) < selectOptionLimit {
+			selectOptions = append(selectOptions, discordgo.SelectMenuOption{
+				Label: "/" + current.cmd.Name, Value: current.cmd.Name,
+			})
+		}
+	}
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: buffer.String(), Flags: discordgo.MessageFlagsEphemeral,
+			Components: h.selectComponents(selectOptions),
+		},
+	})
+}
+
+func (h *helpIndex) selectComponents(selectOptions []discordgo.SelectMenuOption) []discordgo.MessageComponent {
+	if len(selectOptions) == 0 {
+		return nil
+	}
+	return []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+		discordgo.SelectMenu{CustomID: helpSelectId, Placeholder: h.selectLabel, Options: selectOptions},
+	}}}
+}
+
+// display the detail page of the selected command
+func (h *helpIndex) selectCmd(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	infos := h.infosHolder.Get()
+	returnMsg := infos.Msgs.ErrUnauthorized
+	if values := i.MessageComponentData().Values; len(values) != 0 {
+		if current, ok := h.nameToCmd[values[0]]; ok && h.usable(i.Member, current, infos) {
+			returnMsg = h.detail(current, infos)
+		}
+	}
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseUpdateMessage,
+		Data: &discordgo.InteractionResponseData{Content: returnMsg, Components: i.Message.Components},
+	})
+}
+
+func (h *helpIndex) detail(current helpCmd, infos common.GuildAndConfInfo) string {
+	var buffer strings.Builder
+	buffer.WriteString("**/")
+	buffer.WriteString(current.cmd.Name)
+	buffer.WriteString("** (")
+	buffer.WriteString(h.groupTitles[current.group])
+	buffer.WriteString(")\n")
+	buffer.WriteString(current.cmd.Description)
+
+	if roleId, ok := infos.CmdToRoleId[current.cmd.Name]; ok {
+		buffer.WriteByte('\n')
+		buffer.WriteString(h.prefixLabel)
+		buffer.WriteString(" : ")
+		buffer.WriteString(strings.TrimSpace(infos.RoleIdToPrefix[roleId]))
+	}
+
+	for _, option := range current.cmd.Options {
+		buffer.WriteString("\n- ")
+		buffer.WriteString(option.Name)
+		if option.Required {
+			buffer.WriteString(" (")
+			buffer.WriteString(h.requiredLabel)
+			buffer.WriteByte(')')
+		}
+		buffer.WriteString(" : ")
+		buffer.WriteString(option.Description)
+		for _, choice := range option.Choices {
+			buffer.WriteString("\n  - ")
+			buffer.WriteString(choice.Name)
+		}
+	}
+	return buffer.String()
+}
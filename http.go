@@ -0,0 +1,70 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+const httpShutdownTimeout = 5 * time.Second
+
+// httpModule serve the metrics (and the routes added by the other modules) on HTTP_ADDRESS,
+// it must be declared first to create b.mux before the other modules use it
+type httpModule struct {
+	server *http.Server
+}
+
+func (m *httpModule) configure(b *bot) bool {
+	address := b.config.GetString("HTTP_ADDRESS")
+	if address == "" {
+		return false
+	}
+
+	b.mux = http.NewServeMux()
+	m.server = &http.Server{Addr: address, Handler: b.mux, ReadHeaderTimeout: 10 * time.Second}
+	return true
+}
+
+func (m *httpModule) register(b *bot) {
+	b.mux.HandleFunc("GET /metrics", common.MetricsHandler)
+}
+
+func (m *httpModule) start(b *bot) {
+	go m.listen()
+}
+
+func (m *httpModule) listen() {
+	if err := m.server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("HTTP server failed :", err)
+	}
+}
+
+func (m *httpModule) stop(b *bot) {
+	ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := m.server.Shutdown(ctx); err != nil {
+		log.Println("HTTP server shutdown failed :", err)
+	}
+}
@@ -0,0 +1,203 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"cmp"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+type inviteUse struct {
+	inviter string
+	uses    int
+	maxUses int // 0 for unlimited
+}
+
+type inviteStat struct {
+	code string
+	inviteUse
+}
+
+type inviteModule struct {
+	baseModule
+}
+
+func (inviteModule) configure(b *bot) bool {
+	if len(b.rc.inviteToRole) == 0 && b.cmdConfig["INVITE_STATS"].Name == "" {
+		return false
+	}
+
+	b.intents |= discordgo.IntentGuildInvites
+	return true
+}
+
+// the invite used by a new member is detected in the join pipeline
+func (inviteModule) register(b *bot) {
+	invites := makeInviteTracker(b.session, b.guildId)
+	b.invites = invites
+	b.session.AddHandler(func(s *discordgo.Session, i *discordgo.InviteCreate) {
+		invites.add(i.Invite)
+	})
+
+	inviteStatsMsg := b.config.GetString("MESSAGE_INVITE_STATS")
+	b.addAdminCmd(helpGroupMembers, "INVITE_STATS", nil, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		inviteStatsCmd(s, i, invites, inviteStatsMsg, b.infosHolder.Get())
+	})
+}
+
+// inviteTracker keep the invite usage counts to detect which invite a new member used
+type inviteTracker struct {
+	guildId      string
+	codeToInvite map[string]inviteUse
+	mutex        sync.Mutex
+}
+
+func makeInviteTracker(s *discordgo.Session, guildId string) *inviteTracker {
+	tracker := &inviteTracker{guildId: guildId, codeToInvite: map[string]inviteUse{}}
+	if _, err := tracker.refresh(s); err != nil {
+		log.Println("Cannot retrieve the guild invites :", err)
+	}
+	return tracker
+}
+
+// should be called with the lock, return the previous usage counts
+func (tracker *inviteTracker) refresh(s *discordgo.Session) (map[string]inviteUse, error) {
+	invites, err := s.GuildInvites(tracker.guildId)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := tracker.codeToInvite
+	tracker.codeToInvite = make(map[string]inviteUse, len(invites))
+	for _, invite := range invites {
+		inviter := ""
+		if invite.Inviter != nil {
+			inviter = invite.Inviter.Username
+		}
+		tracker.codeToInvite[invite.Code] = inviteUse{inviter: inviter, uses: invite.Uses, maxUses: invite.MaxUses}
+	}
+	return previous, nil
+}
+
+// return the code of the invite used by a new member (empty when it can not be determined)
+func (tracker *inviteTracker) detectUsed(s *discordgo.Session) string {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	previous, err := tracker.refresh(s)
+	if err != nil {
+		log.Println("Cannot retrieve the guild invites (2) :", err)
+		return ""
+	}
+
+	var candidates []string
+	for code, previousUse := range previous {
+		if current, ok := tracker.codeToInvite[code]; ok {
+			if current.uses > previousUse.uses {
+				candidates = append(candidates, code)
+			}
+		} else if previousUse.maxUses != 0 && previousUse.uses+1 == previousUse.maxUses {
+			// an invite reaching its maximum uses is deleted
+			candidates = append(candidates, code)
+		}
+	}
+	for code, current := range tracker.codeToInvite {
+		if _, ok := previous[code]; !ok && current.uses != 0 {
+			// created and used since the last refresh
+			candidates = append(candidates, code)
+		}
+	}
+
+	if len(candidates) != 1 {
+		// several members joined at the same time
+		log.Println("Cannot determine the used invite, candidates :", candidates)
+		return ""
+	}
+	return candidates[0]
+}
+
+func (tracker *inviteTracker) add(invite *discordgo.Invite) {
+	inviter := ""
+	if invite.Inviter != nil {
+		inviter = invite.Inviter.Username
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	tracker.codeToInvite[invite.Code] = inviteUse{inviter: inviter, uses: invite.Uses, maxUses: invite.MaxUses}
+}
+
+func (tracker *inviteTracker) stats(s *discordgo.Session) ([]inviteStat, error) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	if _, err := tracker.refresh(s); err != nil {
+		return nil, err
+	}
+
+	stats := make([]inviteStat, 0, len(tracker.codeToInvite))
+	for code, use := range tracker.codeToInvite {
+		stats = append(stats, inviteStat{code: code, inviteUse: use})
+	}
+	slices.SortFunc(stats, cmpInviteStatUsesDesc)
+	return stats, nil
+}
+
+func inviteStatsCmd(s *discordgo.Session, i *discordgo.InteractionCreate, tracker *inviteTracker, baseMsg string, infos common.GuildAndConfInfo) {
+	common.AuthorizedDeferredCmd(s, i, infos, func() string {
+		stats, err := tracker.stats(s)
+		if err != nil {
+			log.Println("Cannot retrieve the guild invites (3) :", err)
+			return infos.Msgs.ErrGlobal
+		}
+
+		var buffer strings.Builder
+		buffer.WriteString(baseMsg)
+		for _, stat := range stats {
+			buffer.WriteByte('\n')
+			buffer.WriteString(stat.code)
+			if stat.inviter != "" {
+				buffer.WriteString(" (")
+				buffer.WriteString(stat.inviter)
+				buffer.WriteByte(')')
+			}
+			buffer.WriteString(" = ")
+			buffer.WriteString(strconv.Itoa(stat.uses))
+			if roleId, ok := infos.InviteToRoleId[stat.code]; ok {
+				buffer.WriteString(" -> ")
+				buffer.WriteString(roleName(roleId, infos))
+			}
+		}
+		return buffer.String()
+	})
+}
+
+func cmpInviteStatUsesDesc(a inviteStat, b inviteStat) int {
+	if res := cmp.Compare(b.uses, a.uses); res != 0 {
+		return res
+	}
+	return strings.Compare(a.code, b.code)
+}
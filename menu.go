@@ -0,0 +1,173 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+const (
+	chatRuleModalId         = "casiusbot-chat-rule-modal"
+	chatRuleKeywordInputId  = "casiusbot-chat-rule-keyword"
+	chatRuleResponseInputId = "casiusbot-chat-rule-response"
+
+	// max size of a text input value
+	textInputLimit = 4000
+)
+
+func menuTargetMember(s *discordgo.Session, i *discordgo.InteractionCreate, infos common.GuildAndConfInfo) (*discordgo.Member, bool) {
+	member, err := s.GuildMember(infos.GuildId, i.ApplicationCommandData().TargetID)
+	if err != nil {
+		log.Println("Cannot retrieve member (7) :", err)
+		return nil, false
+	}
+	return member, true
+}
+
+func showActivityMenu(ctx context.Context, s *discordgo.Session, i *discordgo.InteractionCreate, activityQuerier chan<- activityQuery, msgs whoisMsgs, dateFormat string, infos common.GuildAndConfInfo) {
+	common.AuthorizedCmd(s, i, infos, func() string {
+		data := i.ApplicationCommandData()
+		userDesc := "<@" + data.TargetID + ">"
+		if user, ok := data.Resolved.Users[data.TargetID]; ok {
+			userDesc = describeUser(user)
+		}
+		activityMsg, ok := lastActivity(ctx, activityQuerier, data.TargetID, msgs, dateFormat)
+		if !ok {
+			return infos.Msgs.ErrGlobal
+		}
+		return userDesc + "\n" + activityMsg
+	})
+}
+
+func resetRoleMenu(s *discordgo.Session, i *discordgo.InteractionCreate, memberQueue *common.MemberQueue, infos common.GuildAndConfInfo) {
+	common.AuthorizedDeferredCmd(s, i, infos, func() string {
+		member, ok := menuTargetMember(s, i, infos)
+		if !ok {
+			return infos.Msgs.ErrGlobal
+		}
+
+		counterError := 0
+		memberQueue.Do(member.User.ID, func() {
+			counterError = resetRole(s, infos, member)
+		})
+		if counterError != 0 {
+			return strings.ReplaceAll(infos.Msgs.ErrPartial, common.NumErrorPlaceHolder, strconv.Itoa(counterError))
+		}
+		return infos.Msgs.Ok
+	})
+}
+
+func applyPrefixMenu(s *discordgo.Session, i *discordgo.InteractionCreate, memberQueue *common.MemberQueue, infos common.GuildAndConfInfo) {
+	common.AuthorizedDeferredCmd(s, i, infos, func() string {
+		member, ok := menuTargetMember(s, i, infos)
+		if !ok {
+			return infos.Msgs.ErrGlobal
+		}
+
+		returnMsg := infos.Msgs.Ok
+		memberQueue.Do(member.User.ID, func() {
+			messageQueue := make(chan common.MultipartMessage, 1)
+			if counterError := applyPrefix(s, messageQueue, true, infos, member); counterError != 0 {
+				returnMsg = strings.ReplaceAll(infos.Msgs.ErrPartial, common.NumErrorPlaceHolder, strconv.Itoa(counterError))
+				return
+			}
+			// nothing is sent for an owner or an ignored member
+			select {
+			case msg := <-messageQueue:
+				returnMsg = msg.Message
+			default:
+			}
+		})
+		return returnMsg
+	})
+}
+
+// the translation is not restricted to authorized roles (unless ROLES or USERS are configured)
+func translateMenu(s *discordgo.Session, i *discordgo.InteractionCreate, translater Translater, infos common.GuildAndConfInfo) {
+	if !infos.AuthorizedPublicMember(i.Member, i.ApplicationCommandData().Name) {
+		common.RespondCmd(s, i, infos, infos.Msgs.ErrUnauthorized)
+		return
+	}
+
+	common.DeferCmd(s, i, infos, func() *discordgo.WebhookEdit {
+		returnMsg := infos.Msgs.ErrGlobal
+		data := i.ApplicationCommandData()
+		if message, ok := data.Resolved.Messages[data.TargetID]; ok && message.Content != "" {
+			returnMsg = translater.Translate(message.Content)
+		}
+		if runes := []rune(returnMsg); len(runes) > messageLimit {
+			returnMsg = string(runes[:messageLimit])
+		}
+		return &discordgo.WebhookEdit{Content: &returnMsg}
+	})
+}
+
+// open a modal to type the keyword, the response is filled with the message content
+func addChatRuleMenu(s *discordgo.Session, i *discordgo.InteractionCreate, keywordLabel string, responseLabel string, infos common.GuildAndConfInfo) {
+	if !infos.Authorized(i) {
+		common.RespondCmd(s, i, infos, infos.Msgs.ErrUnauthorized)
+		return
+	}
+
+	content := ""
+	data := i.ApplicationCommandData()
+	if message, ok := data.Resolved.Messages[data.TargetID]; ok {
+		content = message.Content
+	}
+	if runes := []rune(content); len(runes) > textInputLimit {
+		content = string(runes[:textInputLimit])
+	}
+
+	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: chatRuleModalId, Title: data.Name,
+			Components: []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.TextInput{
+					CustomID: chatRuleKeywordInputId, Label: keywordLabel, Style: discordgo.TextInputShort, Required: true,
+				},
+			}}, discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+				discordgo.TextInput{
+					CustomID: chatRuleResponseInputId, Label: responseLabel, Style: discordgo.TextInputParagraph,
+					Value: content, MaxLength: textInputLimit,
+				},
+			}}},
+		},
+	})
+}
+
+// the modal is not an application command, so the authorization is checked with the menu name
+func chatRuleModal(s *discordgo.Session, i *discordgo.InteractionCreate, menuName string, chat *chatRules, infos common.GuildAndConfInfo) {
+	returnMsg := infos.Msgs.ErrUnauthorized
+	if infos.AuthorizedMember(i.Member, menuName) {
+		returnMsg = infos.Msgs.ErrGlobal
+		modalData := i.ModalSubmitData()
+		keyword := strings.TrimSpace(readModalInput(modalData, chatRuleKeywordInputId))
+		if keyword != "" && chat.register(keyword, readModalInput(modalData, chatRuleResponseInputId)) {
+			returnMsg = infos.Msgs.Ok
+		}
+	}
+	respondEphemeral(s, i, returnMsg)
+}
@@ -0,0 +1,128 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+// the messages which can be changed at runtime (from the admin dashboard)
+var editableMessageKeys = []string{
+	"MESSAGE_CMD_OK", "MESSAGE_CMD_UNAUTHORIZED", "MESSAGE_CMD_GLOBAL_ERROR", "MESSAGE_CMD_PARTIAL_ERROR",
+	"MESSAGE_CMD_COUNT", "MESSAGE_PREFIX", "MESSAGE_NO_CHANGE", "MESSAGE_CMD_ENDED", "MESSAGE_OWNER",
+}
+
+// messageStore hold the editable messages, the changes are saved in MESSAGES_PATH
+// (and override the configuration at the next startup)
+type messageStore struct {
+	path     string
+	keyToMsg map[string]string
+	mutex    sync.RWMutex
+}
+
+func makeMessageStore(config common.Config) *messageStore {
+	keyToMsg := make(map[string]string, len(editableMessageKeys))
+	for _, key := range editableMessageKeys {
+		keyToMsg[key] = config.GetString(key)
+	}
+
+	path := config.GetPath("MESSAGES_PATH")
+	if path != "" {
+		if data, err := os.ReadFile(path); err == nil {
+			var saved map[string]string
+			if err = json.Unmarshal(data, &saved); err == nil {
+				for key, msg := range saved {
+					if _, ok := keyToMsg[key]; ok {
+						keyToMsg[key] = msg
+					}
+				}
+			} else {
+				log.Println("Parsing saved messages failed :", err)
+			}
+		} else if !os.IsNotExist(err) {
+			log.Println("Loading saved messages failed :", err)
+		}
+	}
+	return &messageStore{path: path, keyToMsg: keyToMsg}
+}
+
+// ErrUnauthorized is the template completed with the prefix rules (see roleConf.buildInfos)
+func (s *messageStore) messages() common.Messages {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	errGlobalCmdMsg := s.keyToMsg["MESSAGE_CMD_GLOBAL_ERROR"]
+	errPartialCmdMsg := s.keyToMsg["MESSAGE_CMD_PARTIAL_ERROR"]
+	return common.Messages{
+		Ok:              s.keyToMsg["MESSAGE_CMD_OK"],
+		ErrUnauthorized: s.keyToMsg["MESSAGE_CMD_UNAUTHORIZED"],
+		ErrGlobalCmd:    errGlobalCmdMsg,
+		ErrPartialCmd:   errPartialCmdMsg,
+		Count:           s.keyToMsg["MESSAGE_CMD_COUNT"],
+		Prefix:          s.keyToMsg["MESSAGE_PREFIX"],
+		NoChange:        s.keyToMsg["MESSAGE_NO_CHANGE"],
+		EndedCmd:        s.keyToMsg["MESSAGE_CMD_ENDED"],
+		Owner:           s.keyToMsg["MESSAGE_OWNER"],
+		ErrGlobal:       common.CleanMessage(errGlobalCmdMsg),
+		ErrPartial:      common.CleanMessage(errPartialCmdMsg),
+	}
+}
+
+// return the key and message pairs, in the order of editableMessageKeys
+func (s *messageStore) list() [][2]string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	keyMsgs := make([][2]string, 0, len(editableMessageKeys))
+	for _, key := range editableMessageKeys {
+		keyMsgs = append(keyMsgs, [2]string{key, s.keyToMsg[key]})
+	}
+	return keyMsgs
+}
+
+func (s *messageStore) editable() bool {
+	return s.path != ""
+}
+
+// return false when the message is not editable or when the save failed (the change is still applied)
+func (s *messageStore) set(key string, msg string) bool {
+	if !s.editable() || !slices.Contains(editableMessageKeys, key) {
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keyToMsg[key] = msg
+	data, err := json.Marshal(s.keyToMsg)
+	if err == nil {
+		if err = os.WriteFile(s.path, data, 0644); err == nil {
+			return true
+		}
+		log.Println("Fail to save messages :", err)
+	} else {
+		log.Println("Fail to marshal messages :", err)
+	}
+	return false
+}
@@ -0,0 +1,508 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+const (
+	cmdChannelProblem = "TARGET_CMD_CHANNEL is required for background command messages"
+
+	defaultShutdownTimeout = 10 * time.Second
+)
+
+// module is a feature of the bot, enabled from the configuration
+type module interface {
+	// read and check the configuration before the session is opened, return false when the feature is disabled
+	configure(b *bot) bool
+	// declare the commands and the gateway handlers, called once the guild configuration is resolved
+	register(b *bot)
+	// launch the background workers, called once the commands are synchronized
+	// (they should end when b.ctx is done, the ones with state to flush are counted in b.workers)
+	start(b *bot)
+	// called at shutdown (after the cancellation of b.ctx), in reverse order
+	stop(b *bot)
+}
+
+// baseModule is embedded by the modules without background worker
+type baseModule struct{}
+
+func (baseModule) start(b *bot) {}
+
+func (baseModule) stop(b *bot) {}
+
+// a member update hook return true to stop the processing of the update
+type memberUpdateHook func(s *discordgo.Session, previous memberState, seen bool, member *discordgo.Member) bool
+
+type memberAddHook func(s *discordgo.Session, member *discordgo.Member)
+
+// the state is the last seen one (the remove event does not contain the roles), seen is false when it is unknown
+type memberRemoveHook func(s *discordgo.Session, user *discordgo.User, state memberState, seen bool)
+
+type execFunc = func(*discordgo.Session, *discordgo.InteractionCreate)
+
+// bot hold the state shared between the modules
+type bot struct {
+	config          common.Config
+	guildId         string
+	messages        *messageStore
+	cmdConfig       map[string]common.CmdConf
+	menuConfig      map[string]common.CmdConf
+	adminPermission *int64
+	rc              roleConf
+	dateFormat      string
+	checkInterval   time.Duration
+	targetToRef     map[string]string
+	intents         discordgo.Intent
+	problems        []string
+
+	ctx            context.Context
+	workers        sync.WaitGroup
+	session        *discordgo.Session
+	ownerId        string
+	infosHolder    common.InfosHolder
+	confUpdater    *guildConfUpdater
+	channelManager common.ChannelSenderManager
+	memberQueue    common.MemberQueue
+	cache          memberCache
+	startTime      time.Time
+	// nil without HTTP_ADDRESS
+	mux *http.ServeMux
+	// true once the commands are synchronized, until the shutdown
+	ready atomic.Bool
+	loops *loopMonitor
+	// commands rejected at the synchronization, reported by the diagnose
+	syncProblems []string
+
+	cmds             []*discordgo.ApplicationCommand
+	execCmds         map[string]execFunc
+	execUserMenus    map[string]execFunc
+	execMessageMenus map[string]execFunc
+	execComponents   map[string]execFunc
+	// bulk commands work on all members in background (could be launched by command or scheduled)
+	bulkCmds       map[string]func(*discordgo.Session)
+	cmdToHelpGroup map[string]string
+	publicCmds     common.StringSet
+
+	memberUpdateHooks []memberUpdateHook
+	// final step of the member updates, set by the prefix module
+	prefixUpdate      func(*discordgo.Session, *discordgo.Member)
+	memberAddHooks    []memberAddHook
+	memberRemoveHooks []memberRemoveHook
+
+	// services shared between modules, nil when the feature is disabled
+	snapshots       *snapshotStore
+	history         *nameHistory
+	stickies        *stickyStore
+	invites         *inviteTracker
+	onboard         *onboarding
+	raid            *raidDetector
+	chat            *chatRules
+	feeds           *feedManager
+	activityQuerier chan<- activityQuery
+}
+
+func makeBot(config common.Config) *bot {
+	guildId := config.Require("GUILD_ID")
+
+	messages := makeMessageStore(config)
+	cmdConfig := config.GetCommandConfig()
+	menuConfig := config.GetMenuConfig()
+
+	checkInterval := config.GetDurationSec("CHECK_INTERVAL")
+	if checkInterval == 0 {
+		panic("CHECK_INTERVAL is required")
+	}
+
+	return &bot{
+		config: config, guildId: guildId, messages: messages, cmdConfig: cmdConfig, menuConfig: menuConfig,
+		// hide the admin commands to the members without the permission (when there is no PERMISSIONS on the command)
+		adminPermission: config.GetPermission("ADMIN_CMD_PERMISSIONS"),
+		rc:              readRoleConf(config, guildId, messages.messages(), cmdConfig, menuConfig),
+		dateFormat:      config.GetString("DATE_FORMAT"), checkInterval: checkInterval,
+		targetToRef: map[string]string{
+			targetPrefixChannel:     config.GetString(targetPrefixChannel),
+			targetCmdChannel:        config.GetString(targetCmdChannel),
+			targetActivitiesChannel: config.GetString(targetActivitiesChannel),
+			targetWelcomeChannel:    config.GetString(targetWelcomeChannel),
+			targetAuditChannel:      config.GetString(targetAuditChannel),
+		},
+		memberQueue: common.MakeMemberQueue(), cache: makeMemberCache(), loops: makeLoopMonitor(),
+		execCmds: map[string]execFunc{}, execComponents: map[string]execFunc{},
+		// context menus have their own namespaces
+		execUserMenus: map[string]execFunc{}, execMessageMenus: map[string]execFunc{},
+		bulkCmds: map[string]func(*discordgo.Session){}, cmdToHelpGroup: map[string]string{}, publicCmds: common.StringSet{},
+	}
+}
+
+// all the problems are reported together when the session is opened
+func (b *bot) requireTarget(target string, problem string) {
+	if b.targetToRef[target] == "" && !slices.Contains(b.problems, problem) {
+		b.problems = append(b.problems, problem)
+	}
+}
+
+func (b *bot) cmdChannelSender() chan<- common.MultipartMessage {
+	return b.channelManager.GetTarget(targetCmdChannel)
+}
+
+func (b *bot) addCmd(group string, cmdConf common.CmdConf, options []*discordgo.ApplicationCommandOption, execCmd execFunc) string {
+	var cmdName string
+	cmdName, b.cmds = common.AppendCommand(b.cmds, cmdConf, options)
+	if cmdName != "" {
+		b.execCmds[cmdName] = execCmd
+		b.cmdToHelpGroup[cmdName] = group
+	}
+	return cmdName
+}
+
+// a public command is usable by everyone (unless ROLES or USERS are configured)
+func (b *bot) addPublicCmd(group string, cmdConf common.CmdConf, options []*discordgo.ApplicationCommandOption, execCmd execFunc) string {
+	cmdName := b.addCmd(group, cmdConf, options, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		if infos := b.infosHolder.Get(); !infos.AuthorizedPublicMember(i.Member, i.ApplicationCommandData().Name) {
+			common.RespondCmd(s, i, infos, infos.Msgs.ErrUnauthorized)
+			return
+		}
+		execCmd(s, i)
+	})
+	common.AddNonEmpty(b.publicCmds, cmdName, common.Empty{})
+	return cmdName
+}
+
+func (b *bot) addAdminCmd(group string, confName string, options []*discordgo.ApplicationCommandOption, execCmd execFunc) string {
+	return b.addCmd(group, b.cmdConfig[confName].WithDefaultPermission(b.adminPermission), options, execCmd)
+}
+
+// the bulk command can also be scheduled
+func (b *bot) addBulkCmd(cmdConf common.CmdConf, bulkCmd func(*discordgo.Session)) string {
+	cmdName := b.addCmd(helpGroupPrefix, cmdConf.WithDefaultPermission(b.adminPermission), nil, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		infos := b.infosHolder.Get()
+		common.AuthorizedCmd(s, i, infos, func() string {
+			go bulkCmd(s)
+			return infos.Msgs.Ok
+		})
+	})
+	common.AddNonEmpty(b.bulkCmds, cmdName, bulkCmd)
+	return cmdName
+}
+
+func (b *bot) addMenu(menuType discordgo.ApplicationCommandType, cmdConf common.CmdConf, execMenu execFunc) string {
+	var menuName string
+	menuName, b.cmds = common.AppendMenu(b.cmds, cmdConf, menuType)
+	execByName := b.execUserMenus
+	if menuType == discordgo.MessageApplicationCommand {
+		execByName = b.execMessageMenus
+	}
+	common.AddNonEmpty(execByName, menuName, execMenu)
+	return menuName
+}
+
+func (b *bot) onMemberUpdate(hook memberUpdateHook) {
+	b.memberUpdateHooks = append(b.memberUpdateHooks, hook)
+}
+
+func (b *bot) onMemberAdd(hook memberAddHook) {
+	b.memberAddHooks = append(b.memberAddHooks, hook)
+}
+
+func (b *bot) onMemberRemove(hook memberRemoveHook) {
+	b.memberRemoveHooks = append(b.memberRemoveHooks, hook)
+}
+
+func (b *bot) run(modules []module) {
+	ctx, stopNotify := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	b.ctx = ctx
+
+	enabled := make([]module, 0, len(modules))
+	for _, m := range modules {
+		if m.configure(b) {
+			enabled = append(enabled, m)
+		}
+	}
+
+	b.open()
+	defer b.session.Close()
+
+	for _, m := range enabled {
+		m.register(b)
+	}
+	// a command rejected by Discord is reported by the diagnose (the other features are working)
+	b.syncProblems = common.SyncCommands(b.session, b.session.State.User.ID, b.guildId, b.cmds)
+	b.registerHandlers()
+	b.ready.Store(true)
+
+	b.startTime = time.Now().Add(-b.checkInterval)
+	if backwardLoading := b.config.GetDurationSec("INITIAL_BACKWARD_LOADING"); backwardLoading != 0 {
+		b.startTime = b.startTime.Add(-backwardLoading)
+	}
+	for _, m := range enabled {
+		m.start(b)
+	}
+
+	go common.UpdateGameStatus(ctx, b.session, b.config.GetStringSlice("GAME_LIST"), b.config.GetDurationSec("UPDATE_GAME_INTERVAL"))
+
+	log.Println("Started successfully")
+	fmt.Println("Press Ctrl+C to exit")
+	<-ctx.Done()
+	// a second signal stop the bot without waiting
+	stopNotify()
+	b.shutdown(enabled)
+}
+
+// stop the modules, wait the workers flushing their state and the sending of the queued messages
+func (b *bot) shutdown(enabled []module) {
+	log.Println("Shutting down")
+	b.ready.Store(false)
+	timeout := b.config.GetDurationSec("SHUTDOWN_TIMEOUT")
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	for index := len(enabled) - 1; index >= 0; index-- {
+		enabled[index].stop(b)
+	}
+
+	workersDone := make(chan common.Empty)
+	go func() {
+		b.workers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-time.After(time.Until(deadline)):
+		log.Println("Shutdown timeout reached before the end of the workers")
+	}
+
+	if pending := b.channelManager.Drain(time.Until(deadline)); pending != 0 {
+		log.Println("Shutdown with", pending, "message(s) not sent")
+	}
+}
+
+// open the session and resolve the guild configuration
+func (b *bot) open() {
+	session, err := discordgo.New("Bot " + b.config.Require("BOT_TOKEN"))
+	if err != nil {
+		panic(fmt.Sprint("Cannot create the bot :", err))
+	}
+	session.Identify.Intents |= discordgo.IntentGuildMembers | b.intents
+
+	if err = session.Open(); err != nil {
+		panic(fmt.Sprint("Cannot open the session :", err))
+	}
+	b.session = session
+
+	guild, err := session.Guild(b.guildId)
+	if err != nil {
+		panic(fmt.Sprint("Cannot retrieve the guild :", err))
+	}
+	b.ownerId = guild.OwnerID
+
+	guildChannels, err := session.GuildChannels(b.guildId)
+	if err != nil {
+		panic(fmt.Sprint("Cannot retrieve the guild channels :", err))
+	}
+
+	targetToId, problems := resolveChannels(b.targetToRef, guildChannels)
+	infos, roleProblems := b.rc.buildInfos(b.ownerId, guild.Roles)
+	if problems = append(append(problems, b.problems...), roleProblems...); len(problems) != 0 {
+		panic("Configuration problems :\n" + strings.Join(problems, "\n"))
+	}
+
+	b.infosHolder = common.MakeInfosHolder(infos)
+	b.channelManager = common.MakeChannelSenderManager(session)
+	for target, ref := range b.targetToRef {
+		// an unconfigured target stay disabled (with a nil sender)
+		if ref != "" {
+			b.channelManager.SetTarget(target, targetToId[target])
+		}
+	}
+
+	b.confUpdater = &guildConfUpdater{
+		rc: b.rc, targetToRef: b.targetToRef, infosHolder: &b.infosHolder, manager: b.channelManager,
+		warningMsg: b.config.GetString("MESSAGE_CONF_WARNING"),
+	}
+	// the events from the other guilds (and the private channels) are ignored
+	session.AddHandler(func(s *discordgo.Session, u *discordgo.GuildRoleCreate) {
+		if u.GuildID == b.guildId {
+			b.confUpdater.updateRoles(s)
+		}
+	})
+	session.AddHandler(func(s *discordgo.Session, u *discordgo.GuildRoleUpdate) {
+		if u.GuildID == b.guildId {
+			b.confUpdater.updateRoles(s)
+		}
+	})
+	session.AddHandler(func(s *discordgo.Session, u *discordgo.GuildRoleDelete) {
+		if u.GuildID == b.guildId {
+			b.confUpdater.updateRoles(s)
+		}
+	})
+	session.AddHandler(func(s *discordgo.Session, u *discordgo.ChannelCreate) {
+		if u.GuildID == b.guildId {
+			b.confUpdater.updateChannels(s)
+		}
+	})
+	session.AddHandler(func(s *discordgo.Session, u *discordgo.ChannelUpdate) {
+		if u.GuildID == b.guildId {
+			b.confUpdater.updateChannels(s)
+		}
+	})
+	session.AddHandler(func(s *discordgo.Session, u *discordgo.ChannelDelete) {
+		if u.GuildID == b.guildId {
+			b.confUpdater.updateChannels(s)
+		}
+	})
+}
+
+// dispatch the gateway events to the hooks and the interactions to the declared commands
+func (b *bot) registerHandlers() {
+	// the session is already opened, so the first connection is not seen
+	b.session.AddHandler(func(s *discordgo.Session, c *discordgo.Connect) {
+		common.Reconnects.Inc("")
+	})
+
+	b.session.AddHandler(func(s *discordgo.Session, u *discordgo.GuildMemberUpdate) {
+		if u.User.ID == b.ownerId {
+			return
+		}
+
+		previous, seen := b.cache.set(u.Member)
+		for _, hook := range b.memberUpdateHooks {
+			if hook(s, previous, seen, u.Member) {
+				return
+			}
+		}
+		// the prefix rules are applied last, whatever the order of the modules
+		if b.prefixUpdate != nil {
+			b.prefixUpdate(s, u.Member)
+		}
+	})
+
+	b.session.AddHandler(func(s *discordgo.Session, u *discordgo.GuildMemberRemove) {
+		userId := u.User.ID
+		// the event does not contain the roles, so the last seen state is used
+		state, seen := b.cache.get(userId)
+		if !seen && u.Member != nil && len(u.Member.Roles) != 0 {
+			state, seen = makeMemberState(u.Member), true
+		}
+		for _, hook := range b.memberRemoveHooks {
+			hook(s, u.User, state, seen)
+		}
+		b.cache.remove(userId)
+	})
+
+	if len(b.memberAddHooks) != 0 {
+		b.session.AddHandler(func(s *discordgo.Session, r *discordgo.GuildMemberAdd) {
+			for _, hook := range b.memberAddHooks {
+				hook(s, r.Member)
+			}
+		})
+	}
+
+	if b.rc.joiningRole != "" || b.stickies != nil || b.invites != nil || b.onboard != nil || b.raid != nil {
+		// joining rule is after prefix rule, to manage case where joining role have a prefix
+		b.session.AddHandler(func(s *discordgo.Session, r *discordgo.GuildMemberAdd) {
+			infos := b.infosHolder.Get()
+			join := heldJoin{member: r.Member, joiningRoleId: infos.JoiningRoleId}
+			if b.invites != nil {
+				// always called to keep the usage counts up to date
+				if roleId, ok := infos.InviteToRoleId[b.invites.detectUsed(s)]; ok {
+					join.joiningRoleId = roleId
+				}
+			}
+
+			if b.stickies != nil {
+				if sticky, ok := b.stickies.pop(r.User.ID); ok {
+					join.sticky = &sticky
+				}
+			}
+
+			// during a lockdown, the join is processed when it is lifted
+			if b.raid == nil || !b.raid.join(s, join, infos) {
+				b.processJoin(s, join)
+			}
+		})
+	}
+
+	b.session.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		switch i.Type {
+		case discordgo.InteractionApplicationCommand:
+			execByName := b.execCmds
+			data := i.ApplicationCommandData()
+			switch data.CommandType {
+			case discordgo.UserApplicationCommand:
+				execByName = b.execUserMenus
+			case discordgo.MessageApplicationCommand:
+				execByName = b.execMessageMenus
+			}
+			if execCmd, ok := execByName[data.Name]; ok {
+				common.CommandsRun.Inc(data.Name)
+				execCmd(s, i)
+			}
+		case discordgo.InteractionMessageComponent:
+			if execComponent, ok := b.execComponents[i.MessageComponentData().CustomID]; ok {
+				execComponent(s, i)
+			}
+		case discordgo.InteractionModalSubmit:
+			if execModal, ok := b.execComponents[i.ModalSubmitData().CustomID]; ok {
+				execModal(s, i)
+			}
+		}
+	})
+}
+
+func (b *bot) processJoin(s *discordgo.Session, join heldJoin) {
+	if b.onboard != nil {
+		// roles are given after the verification
+		b.onboard.welcome(s, join.member, join.joiningRoleId, join.sticky)
+		return
+	}
+
+	userId := join.member.User.ID
+	if join.sticky != nil {
+		// a returning member get back its roles instead of the joining role
+		infos := b.infosHolder.Get()
+		b.memberQueue.Do(userId, func() {
+			restoreSticky(s, *join.sticky, infos, join.member)
+		})
+		return
+	}
+
+	if join.joiningRoleId != "" {
+		if err := s.GuildMemberRoleAdd(b.guildId, userId, join.joiningRoleId); err != nil {
+			log.Println("Joining role addition failed :", err)
+		}
+	}
+}
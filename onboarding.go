@@ -0,0 +1,291 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+const verifyButtonId = "casiusbot-verify"
+
+type pendingMember struct {
+	joinedAt      time.Time
+	joiningRoleId string
+	sticky        *stickyMember
+	reminded      bool
+}
+
+type onboardingModule struct {
+	baseModule
+}
+
+func (onboardingModule) configure(b *bot) bool {
+	if b.rc.quarantineRole == "" {
+		return false
+	}
+
+	b.requireTarget(targetWelcomeChannel, "TARGET_WELCOME_CHANNEL is required for the verification button")
+	return true
+}
+
+// the new members are welcomed in the join pipeline
+func (onboardingModule) register(b *bot) {
+	onboard := makeOnboarding(b.config, &b.memberQueue, &b.infosHolder, b.channelManager)
+	onboard.loadPending(b.session)
+	b.onboard = onboard
+
+	b.execComponents[verifyButtonId] = onboard.verifyButton
+	if onboard.captchas != nil {
+		b.execComponents[captchaAnswerButtonId] = onboard.captchas.answerButton
+		b.execComponents[captchaModalId] = onboard.captchaModal
+	}
+
+	b.onMemberRemove(func(s *discordgo.Session, user *discordgo.User, state memberState, seen bool) {
+		onboard.forget(user.ID)
+	})
+}
+
+func (onboardingModule) start(b *bot) {
+	go b.onboard.checkEvery(b.ctx, b.session, time.Minute)
+}
+
+// onboarding keep the new members in the quarantine role until they accept the rules
+type onboarding struct {
+	memberQueue *common.MemberQueue
+	infosHolder *common.InfosHolder
+	manager     common.ChannelSenderManager
+	welcomeMsg  string
+	rulesMsg    string
+	buttonLabel string
+	verifiedMsg string
+	reminderMsg string
+	remindDelay time.Duration
+	kickDelay   time.Duration
+	captchas    *captchaChecker // nil when disabled
+	idToPending map[string]pendingMember
+	mutex       sync.Mutex
+}
+
+func makeOnboarding(config common.Config, memberQueue *common.MemberQueue, infosHolder *common.InfosHolder, manager common.ChannelSenderManager) *onboarding {
+	var captchas *captchaChecker
+	if config.GetBool("CAPTCHA") {
+		captchas = makeCaptchaChecker(config)
+	}
+
+	return &onboarding{
+		memberQueue: memberQueue, infosHolder: infosHolder, manager: manager,
+		welcomeMsg: config.Require("MESSAGE_WELCOME"), rulesMsg: config.GetString("MESSAGE_RULES"),
+		buttonLabel: config.Require("LABEL_VERIFY_BUTTON"), verifiedMsg: config.GetString("MESSAGE_VERIFIED"),
+		reminderMsg: config.GetString("MESSAGE_VERIFY_REMINDER"), remindDelay: config.GetDurationSec("VERIFY_REMIND_DELAY"),
+		kickDelay: config.GetDurationSec("VERIFY_KICK_DELAY"), captchas: captchas, idToPending: map[string]pendingMember{},
+	}
+}
+
+// retrieve the members still in quarantine (after a restart)
+func (o *onboarding) loadPending(s *discordgo.Session) {
+	infos := o.infosHolder.Get()
+	guildMembers, err := s.GuildMembers(infos.GuildId, "", common.MemberCallLimit)
+	if err != nil {
+		log.Println("Cannot retrieve guild members (8) :", err)
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	for _, member := range guildMembers {
+		if slices.Contains(member.Roles, infos.QuarantineRoleId) {
+			// the joining role depending on the invite is lost
+			o.idToPending[member.User.ID] = pendingMember{joinedAt: member.JoinedAt, joiningRoleId: infos.JoiningRoleId}
+		}
+	}
+}
+
+// put the new member in quarantine, the joining role (and the sticky data) are applied on verification
+func (o *onboarding) welcome(s *discordgo.Session, member *discordgo.Member, joiningRoleId string, sticky *stickyMember) {
+	infos := o.infosHolder.Get()
+	userId := member.User.ID
+	o.memberQueue.Do(userId, func() {
+		if err := s.GuildMemberRoleAdd(infos.GuildId, userId, infos.QuarantineRoleId); err != nil {
+			log.Println("Quarantine role addition failed :", err)
+		}
+	})
+
+	o.mutex.Lock()
+	o.idToPending[userId] = pendingMember{joinedAt: time.Now(), joiningRoleId: joiningRoleId, sticky: sticky}
+	o.mutex.Unlock()
+
+	o.manager.GetTarget(targetWelcomeChannel) <- common.MultipartMessage{
+		Message:    strings.ReplaceAll(o.welcomeMsg, common.UserPlaceHolder, member.Mention()),
+		Components: o.verifyComponents(),
+	}
+	if o.rulesMsg != "" {
+		if err := common.SendDirectMessage(s, userId, o.rulesMsg); err != nil {
+			log.Println("Cannot send the rules :", err)
+		}
+	}
+}
+
+func (o *onboarding) verifyComponents() []discordgo.MessageComponent {
+	return []discordgo.MessageComponent{discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+		discordgo.Button{Label: o.buttonLabel, Style: discordgo.SuccessButton, CustomID: verifyButtonId},
+	}}}
+}
+
+// called when a member press the button
+func (o *onboarding) verifyButton(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	infos := o.infosHolder.Get()
+	returnMsg := o.verifiedMsg
+	if member := i.Member; member != nil && slices.Contains(member.Roles, infos.QuarantineRoleId) {
+		if o.captchas == nil {
+			returnMsg = o.verified(s, infos, member)
+		} else {
+			returnMsg = o.captchas.challenge(s, member.User.ID, infos)
+		}
+	}
+	respondEphemeral(s, i, returnMsg)
+}
+
+// called when a member submit the captcha answer
+func (o *onboarding) captchaModal(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	infos := o.infosHolder.Get()
+	ok, returnMsg := o.captchas.check(s, i, infos)
+	if ok {
+		if member, err := s.GuildMember(infos.GuildId, interactionUserId(i)); err == nil {
+			returnMsg = o.verified(s, infos, member)
+		} else {
+			log.Println("Cannot retrieve member (5) :", err)
+			returnMsg = infos.Msgs.ErrGlobal
+		}
+	}
+	respondEphemeral(s, i, returnMsg)
+}
+
+// return the message for the interaction response
+func (o *onboarding) verified(s *discordgo.Session, infos common.GuildAndConfInfo, member *discordgo.Member) string {
+	userId := member.User.ID
+	o.mutex.Lock()
+	pending, ok := o.idToPending[userId]
+	delete(o.idToPending, userId)
+	o.mutex.Unlock()
+	if !ok {
+		pending.joiningRoleId = infos.JoiningRoleId
+	}
+
+	returnMsg := o.verifiedMsg
+	o.memberQueue.Do(userId, func() {
+		if o.release(s, pending, infos, member) != 0 {
+			returnMsg = infos.Msgs.ErrGlobal
+		}
+	})
+	return returnMsg
+}
+
+func (o *onboarding) release(s *discordgo.Session, pending pendingMember, infos common.GuildAndConfInfo, member *discordgo.Member) int {
+	userId := member.User.ID
+	counterError := 0
+	if err := s.GuildMemberRoleRemove(infos.GuildId, userId, infos.QuarantineRoleId); err != nil {
+		log.Println("Quarantine role removing failed :", err)
+		common.ApiErrors.Inc("role")
+		return 1
+	}
+
+	if pending.sticky != nil {
+		return restoreSticky(s, *pending.sticky, infos, member)
+	}
+
+	if pending.joiningRoleId != "" {
+		if err := s.GuildMemberRoleAdd(infos.GuildId, userId, pending.joiningRoleId); err != nil {
+			log.Println("Joining role addition failed (2) :", err)
+			common.ApiErrors.Inc("role")
+			counterError++
+		}
+	}
+
+	// add the default role if needed
+	if member, err := s.GuildMember(infos.GuildId, userId); err == nil {
+		counterError += applyPrefix(s, nil, false, infos, member)
+	} else {
+		log.Println("Cannot retrieve member (4) :", err)
+		common.ApiErrors.Inc("member")
+		counterError++
+	}
+	return counterError
+}
+
+func (o *onboarding) forget(userId string) {
+	if o.captchas != nil {
+		o.captchas.forget(userId)
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	delete(o.idToPending, userId)
+}
+
+// remind or kick the members who did not accept the rules (or did not answer the captcha) in time
+func (o *onboarding) checkEvery(ctx context.Context, s *discordgo.Session, interval time.Duration) {
+	if o.remindDelay <= 0 && o.kickDelay <= 0 && o.captchas == nil {
+		return
+	}
+
+	for range common.Tick(ctx, interval) {
+		infos := o.infosHolder.Get()
+		if o.captchas != nil {
+			o.captchas.expire(s, infos)
+		}
+
+		now := time.Now()
+		var toRemind, toKick []string
+		o.mutex.Lock()
+		for userId, pending := range o.idToPending {
+			waited := now.Sub(pending.joinedAt)
+			if o.kickDelay > 0 && waited > o.kickDelay {
+				toKick = append(toKick, userId)
+				delete(o.idToPending, userId)
+			} else if o.remindDelay > 0 && !pending.reminded && waited > o.remindDelay {
+				toRemind = append(toRemind, userId)
+				pending.reminded = true
+				o.idToPending[userId] = pending
+			}
+		}
+		o.mutex.Unlock()
+
+		for _, userId := range toRemind {
+			if o.reminderMsg == "" {
+				break
+			}
+			if err := common.SendDirectMessage(s, userId, o.reminderMsg); err != nil {
+				log.Println("Cannot send the verification reminder :", err)
+			}
+		}
+		for _, userId := range toKick {
+			if err := s.GuildMemberDeleteWithReason(infos.GuildId, userId, "rules not accepted in time"); err != nil {
+				log.Println("Unverified member kick failed :", err)
+			}
+		}
+	}
+}
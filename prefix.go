@@ -33,6 +33,75 @@ const (
 	REMOVE_ALL
 )
 
+// prefixModule apply the prefix rules on member updates and declare the bulk commands on prefixes
+type prefixModule struct {
+	baseModule
+	memberReconciler *reconciler
+}
+
+func (*prefixModule) configure(b *bot) bool {
+	if b.cmdConfig["APPLY"].Name != "" || b.cmdConfig["CLEAN"].Name != "" {
+		b.requireTarget(targetCmdChannel, cmdChannelProblem)
+	}
+	return true
+}
+
+func (m *prefixModule) register(b *bot) {
+	cmdChannelSender := b.cmdChannelSender()
+	prefixChannelSender := b.channelManager.GetTarget(targetPrefixChannel)
+
+	m.memberReconciler = &reconciler{
+		memberQueue: &b.memberQueue, cache: &b.cache, infosHolder: &b.infosHolder,
+		messageSender: cmdChannelSender, msg: b.config.GetString("MESSAGE_RECONCILE"), held: b.raid,
+	}
+	// after a reconnection, the updates sent during the disconnection are lost
+	b.session.AddHandler(func(s *discordgo.Session, r *discordgo.Ready) {
+		m.memberReconciler.reconcileAndSend(s)
+	})
+	b.session.AddHandler(func(s *discordgo.Session, r *discordgo.Resumed) {
+		m.memberReconciler.reconcileAndSend(s)
+	})
+
+	// called after all the member update hooks (which can stop the processing before)
+	b.prefixUpdate = func(s *discordgo.Session, member *discordgo.Member) {
+		if b.raid != nil && b.raid.isHeld(member.User.ID) {
+			// the join is processed at the end of the lockdown
+			return
+		}
+		// the update is queued, so it will be applied after the running operation on the same member
+		b.memberQueue.Update(member.User.ID, func() {
+			applyPrefix(s, prefixChannelSender, false, b.infosHolder.Get(), member)
+		})
+	}
+
+	applyName := b.cmdConfig["APPLY"].Name
+	b.addBulkCmd(b.cmdConfig["APPLY"], func(s *discordgo.Session) {
+		infos := b.infosHolder.Get()
+		common.ProcessGuildMembers(s, cmdChannelSender, b.guildId, infos.Msgs.ReplaceCmdPlaceHolder(applyName), &b.memberQueue, nil, func(guildMember *discordgo.Member) int {
+			return applyPrefix(s, nil, false, infos, guildMember)
+		})
+	})
+	cleanName := b.cmdConfig["CLEAN"].Name
+	b.addBulkCmd(b.cmdConfig["CLEAN"], func(s *discordgo.Session) {
+		infos := b.infosHolder.Get()
+		common.ProcessGuildMembers(s, cmdChannelSender, b.guildId, infos.Msgs.ReplaceCmdPlaceHolder(cleanName), &b.memberQueue, nil, func(guildMember *discordgo.Member) int {
+			return cleanPrefix(s, infos, guildMember)
+		})
+	})
+
+	b.addMenu(discordgo.UserApplicationCommand, b.menuConfig["APPLY_PREFIX"].WithDefaultPermission(b.adminPermission), func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		applyPrefixMenu(s, i, &b.memberQueue, b.infosHolder.Get())
+	})
+}
+
+func (m *prefixModule) start(b *bot) {
+	// with an empty cache, all members are processed
+	if counterMember, counterError := m.memberReconciler.reconcile(b.session); counterError != 0 {
+		log.Println("Trying to apply prefixes at startup on", counterMember, "member(s) generate errors :", counterError)
+	}
+	go m.memberReconciler.reconcileEvery(b.ctx, b.session, b.config.GetDurationSec("RECONCILE_INTERVAL"))
+}
+
 func transformNick(nickName string, roleIds []string, info common.GuildAndConfInfo) (string, string, uint8) {
 	cleanedNickName := cleanPrefixInNick(nickName, info.Prefixes)
 	nickName = cleanedNickName
@@ -63,7 +132,8 @@ func transformNick(nickName string, roleIds []string, info common.GuildAndConfIn
 		if hasPrefix {
 			action = REMOVE_DEFAULT
 		}
-	} else if !hasPrefix {
+	} else if !hasPrefix && info.DefaultRoleId != "" {
+		// the default role could be deleted in the guild (the problem is only warned)
 		action = ADD_DEFAULT
 	}
 	return nickName, usedRoleId, action
@@ -90,11 +160,13 @@ func applyPrefix(s *discordgo.Session, messageSender chan<- common.MultipartMess
 		case ADD_DEFAULT:
 			if err := s.GuildMemberRoleAdd(infos.GuildId, userId, infos.DefaultRoleId); err != nil {
 				log.Println("Role addition failed :", err)
+				common.ApiErrors.Inc("role")
 				counterError++
 			}
 		case REMOVE_DEFAULT:
 			if err := s.GuildMemberRoleRemove(infos.GuildId, userId, infos.DefaultRoleId); err != nil {
 				log.Println("Role removing failed :", err)
+				common.ApiErrors.Inc("role")
 				counterError++
 			}
 		case REMOVE_ALL:
@@ -102,6 +174,7 @@ func applyPrefix(s *discordgo.Session, messageSender chan<- common.MultipartMess
 				if _, ok := infos.RoleIdToPrefix[roleId]; ok || roleId == infos.DefaultRoleId {
 					if err := s.GuildMemberRoleRemove(infos.GuildId, userId, roleId); err != nil {
 						log.Println("Role removing failed (2) :", err)
+						common.ApiErrors.Inc("role")
 						counterError++
 					}
 				}
@@ -109,7 +182,7 @@ func applyPrefix(s *discordgo.Session, messageSender chan<- common.MultipartMess
 		}
 		if newNick == nick {
 			if forceSend && messageSender != nil {
-				msg := strings.ReplaceAll(infos.Msgs.NoChange, "{{user}}", nick)
+				msg := strings.ReplaceAll(infos.Msgs.NoChange, common.UserPlaceHolder, nick)
 				msg = strings.ReplaceAll(msg, common.RolePlaceHolder, infos.RoleIdToDisplayName[usedRoleId])
 				messageSender <- common.MultipartMessage{Message: msg}
 			}
@@ -122,6 +195,7 @@ func applyPrefix(s *discordgo.Session, messageSender chan<- common.MultipartMess
 				}
 			} else {
 				log.Println("Nickname change failed (2) :", err)
+				common.ApiErrors.Inc("nickname")
 				counterError++
 			}
 		}
@@ -137,6 +211,7 @@ func cleanPrefix(s *discordgo.Session, infos common.GuildAndConfInfo, guildMembe
 		if newNick != nick {
 			if err := s.GuildMemberNickname(infos.GuildId, userId, newNick); err != nil {
 				log.Println("Nickname change failed :", err)
+				common.ApiErrors.Inc("nickname")
 				counterError++
 			}
 		}
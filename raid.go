@@ -0,0 +1,292 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+type joinRecord struct {
+	at         time.Time
+	userId     string
+	newAccount bool
+}
+
+// a join waiting the end of the lockdown
+type heldJoin struct {
+	member        *discordgo.Member
+	joiningRoleId string
+	sticky        *stickyMember
+}
+
+type raidModule struct {
+	baseModule
+}
+
+func (raidModule) configure(b *bot) bool {
+	if b.config.GetInt("RAID_JOIN_THRESHOLD") <= 0 {
+		return false
+	}
+
+	b.requireTarget(targetCmdChannel, cmdChannelProblem)
+	return true
+}
+
+// the joins are held in the join pipeline
+func (raidModule) register(b *bot) {
+	raid := makeRaidDetector(b.config, b.cmdChannelSender(), b.processJoin)
+	b.raid = raid
+
+	noLockdownMsg := b.config.GetString("MESSAGE_NO_LOCKDOWN")
+	b.addAdminCmd(helpGroupMembers, "LIFT_LOCKDOWN", nil, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		liftLockdownCmd(s, i, raid, noLockdownMsg, b.infosHolder.Get())
+	})
+
+	b.onMemberRemove(func(s *discordgo.Session, user *discordgo.User, state memberState, seen bool) {
+		raid.forget(user.ID)
+	})
+}
+
+func (raidModule) start(b *bot) {
+	go b.raid.liftEvery(b.ctx, b.session, time.Minute)
+}
+
+// raidDetector track the joins in a sliding window and hold them in lockdown when thresholds are exceeded
+type raidDetector struct {
+	window           time.Duration
+	joinThreshold    int
+	newAccountAge    time.Duration
+	newAccountRatio  int // percent
+	lockdownDuration time.Duration
+	timeoutDuration  time.Duration
+	messageSender    chan<- common.MultipartMessage
+	alertMsg         string
+	liftedMsg        string
+	release          func(*discordgo.Session, heldJoin)
+	joins            []joinRecord
+	lockdown         bool
+	lockdownEnd      time.Time
+	held             []heldJoin
+	heldIds          common.StringSet // until the release (even after the lift)
+	mutex            sync.Mutex
+}
+
+func makeRaidDetector(config common.Config, messageSender chan<- common.MultipartMessage, release func(*discordgo.Session, heldJoin)) *raidDetector {
+	window := config.GetDurationSec("RAID_WINDOW")
+	if window <= 0 {
+		panic("RAID_WINDOW is required with RAID_JOIN_THRESHOLD")
+	}
+
+	return &raidDetector{
+		window: window, joinThreshold: config.GetInt("RAID_JOIN_THRESHOLD"),
+		newAccountAge: config.GetDurationDay("RAID_NEW_ACCOUNT_AGE"), newAccountRatio: config.GetInt("RAID_NEW_ACCOUNT_RATIO"),
+		lockdownDuration: config.GetDurationSec("RAID_LOCKDOWN_DURATION"), timeoutDuration: config.GetDurationSec("RAID_TIMEOUT"),
+		messageSender: messageSender, alertMsg: config.GetString("MESSAGE_RAID_ALERT"),
+		liftedMsg: config.GetString("MESSAGE_RAID_LIFTED"), release: release, heldIds: common.StringSet{},
+	}
+}
+
+func (r *raidDetector) isNewAccount(userId string, now time.Time) bool {
+	created, err := discordgo.SnowflakeTimestamp(userId)
+	if err != nil {
+		log.Println("Cannot read the account creation date :", err)
+		return false
+	}
+	return now.Sub(created) < r.newAccountAge
+}
+
+// return true when the join is held (the lockdown could start with this join)
+func (r *raidDetector) join(s *discordgo.Session, held heldJoin, infos common.GuildAndConfInfo) bool {
+	now := time.Now()
+	userId := held.member.User.ID
+	isHeld, timeoutIds, alert := r.record(held, r.isNewAccount(userId, now), now, infos)
+
+	// the API calls and the alert are done without the lock
+	for _, timeoutId := range timeoutIds {
+		r.timeout(s, timeoutId, now, infos)
+	}
+	if alert != "" {
+		r.messageSender <- common.MultipartMessage{Message: alert}
+	}
+	return isHeld
+}
+
+// return the suspicious accounts to timeout and the alert to send (empty without new lockdown)
+func (r *raidDetector) record(held heldJoin, newAccount bool, now time.Time, infos common.GuildAndConfInfo) (bool, []string, string) {
+	userId := held.member.User.ID
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	limit := now.Add(-r.window)
+	kept := r.joins[:0]
+	for _, record := range r.joins {
+		if record.at.After(limit) {
+			kept = append(kept, record)
+		}
+	}
+	r.joins = append(kept, joinRecord{at: now, userId: userId, newAccount: newAccount})
+
+	var timeoutIds []string
+	alert := ""
+	if !r.lockdown {
+		joinCount := len(r.joins)
+		newCount := 0
+		for _, record := range r.joins {
+			if record.newAccount {
+				newCount++
+			}
+		}
+		if joinCount < r.joinThreshold || newCount*100 < r.newAccountRatio*joinCount {
+			return false, nil, ""
+		}
+
+		timeoutIds, alert = r.startLockdown(now, infos)
+	} else if newAccount {
+		timeoutIds = append(timeoutIds, userId)
+	}
+
+	r.held = append(r.held, held)
+	r.heldIds[userId] = common.Empty{}
+	return true, timeoutIds, alert
+}
+
+// should be called with the lock
+func (r *raidDetector) startLockdown(now time.Time, infos common.GuildAndConfInfo) ([]string, string) {
+	r.lockdown = true
+	if r.lockdownDuration > 0 {
+		r.lockdownEnd = now.Add(r.lockdownDuration)
+	}
+	log.Println("Raid detected, lockdown started")
+
+	// the suspicious accounts which already joined are included
+	var timeoutIds []string
+	for _, record := range r.joins {
+		if record.newAccount {
+			timeoutIds = append(timeoutIds, record.userId)
+		}
+	}
+
+	if r.messageSender == nil {
+		return timeoutIds, ""
+	}
+
+	var buffer strings.Builder
+	for roleId := range infos.AuthorizedRoleIds {
+		buffer.WriteString("<@&")
+		buffer.WriteString(roleId)
+		buffer.WriteString("> ")
+	}
+	buffer.WriteString(strings.ReplaceAll(r.alertMsg, countPlaceHolder, strconv.Itoa(len(r.joins))))
+	return timeoutIds, buffer.String()
+}
+
+func (r *raidDetector) timeout(s *discordgo.Session, userId string, now time.Time, infos common.GuildAndConfInfo) {
+	if r.timeoutDuration > 0 {
+		until := now.Add(r.timeoutDuration)
+		if err := s.GuildMemberTimeout(infos.GuildId, userId, &until); err != nil {
+			log.Println("Suspicious account timeout failed :", err)
+		}
+	}
+}
+
+// a held member must not be processed (by the prefix rules) before its release
+func (r *raidDetector) isHeld(userId string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, ok := r.heldIds[userId]
+	return ok
+}
+
+// end the lockdown and release the held joins, return false when there was no lockdown
+func (r *raidDetector) lift(s *discordgo.Session) bool {
+	r.mutex.Lock()
+	if !r.lockdown {
+		r.mutex.Unlock()
+		return false
+	}
+	held := r.held
+	r.held = nil
+	r.lockdown = false
+	r.lockdownEnd = time.Time{}
+	r.joins = nil
+	r.mutex.Unlock()
+
+	log.Println("Lockdown lifted, releasing", len(held), "held join(s)")
+	go r.releaseAll(s, held)
+	return true
+}
+
+func (r *raidDetector) releaseAll(s *discordgo.Session, held []heldJoin) {
+	for _, heldJoin := range held {
+		r.mutex.Lock()
+		delete(r.heldIds, heldJoin.member.User.ID)
+		r.mutex.Unlock()
+
+		r.release(s, heldJoin)
+	}
+	if r.messageSender != nil {
+		r.messageSender <- common.MultipartMessage{Message: strings.ReplaceAll(r.liftedMsg, countPlaceHolder, strconv.Itoa(len(held)))}
+	}
+}
+
+func (r *raidDetector) forget(userId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for index, heldJoin := range r.held {
+		if heldJoin.member.User.ID == userId {
+			r.held = append(r.held[:index], r.held[index+1:]...)
+			break
+		}
+	}
+	delete(r.heldIds, userId)
+}
+
+// lift automatically the lockdown after its duration
+func (r *raidDetector) liftEvery(ctx context.Context, s *discordgo.Session, interval time.Duration) {
+	if r.lockdownDuration <= 0 {
+		return
+	}
+
+	for now := range common.Tick(ctx, interval) {
+		r.mutex.Lock()
+		ended := r.lockdown && now.After(r.lockdownEnd)
+		r.mutex.Unlock()
+		if ended {
+			r.lift(s)
+		}
+	}
+}
+
+func liftLockdownCmd(s *discordgo.Session, i *discordgo.InteractionCreate, r *raidDetector, noLockdownMsg string, infos common.GuildAndConfInfo) {
+	common.AuthorizedCmd(s, i, infos, func() string {
+		if r.lift(s) {
+			return infos.Msgs.Ok
+		}
+		return noLockdownMsg
+	})
+}
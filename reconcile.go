@@ -0,0 +1,145 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+const countPlaceHolder = "{{count}}"
+
+type memberState struct {
+	roleIds []string // sorted
+	nick    string
+}
+
+func makeMemberState(member *discordgo.Member) memberState {
+	roleIds := slices.Clone(member.Roles)
+	slices.Sort(roleIds)
+	return memberState{roleIds: roleIds, nick: common.ExtractNick(member)}
+}
+
+func (s memberState) equal(other memberState) bool {
+	return s.nick == other.nick && slices.Equal(s.roleIds, other.roleIds)
+}
+
+// memberCache keep the last seen state of each member
+type memberCache struct {
+	idToState map[string]memberState
+	mutex     sync.RWMutex
+}
+
+func makeMemberCache() memberCache {
+	return memberCache{idToState: map[string]memberState{}}
+}
+
+// return the previous state (ok is false when the member was not seen)
+func (c *memberCache) set(member *discordgo.Member) (memberState, bool) {
+	state := makeMemberState(member)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	previous, ok := c.idToState[member.User.ID]
+	c.idToState[member.User.ID] = state
+	return previous, ok
+}
+
+func (c *memberCache) get(userId string) (memberState, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	state, ok := c.idToState[userId]
+	return state, ok
+}
+
+func (c *memberCache) remove(userId string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.idToState, userId)
+}
+
+// reconciler apply the prefix rules on the members changed since their last seen state
+// (to catch up the updates missed during a gateway disconnection or a downtime)
+type reconciler struct {
+	memberQueue   *common.MemberQueue
+	cache         *memberCache
+	infosHolder   *common.InfosHolder
+	messageSender chan<- common.MultipartMessage
+	msg           string
+	held          *raidDetector // nil without raid detection
+	running       sync.Mutex
+}
+
+// return the number of processed members and the number of errors
+func (r *reconciler) reconcile(s *discordgo.Session) (int, int) {
+	if !r.running.TryLock() {
+		// a reconciliation is already running
+		return 0, 0
+	}
+	defer r.running.Unlock()
+
+	infos := r.infosHolder.Get()
+	guildMembers, err := s.GuildMembers(infos.GuildId, "", common.MemberCallLimit)
+	if err != nil {
+		log.Println("Cannot retrieve guild members (6) :", err)
+		return 0, 1
+	}
+
+	counterMember, counterError := 0, 0
+	for _, member := range guildMembers {
+		if r.held != nil && r.held.isHeld(member.User.ID) {
+			// not cached, to be processed after the release
+			continue
+		}
+		if previous, ok := r.cache.set(member); ok && previous.equal(makeMemberState(member)) {
+			continue
+		}
+
+		counterMember++
+		r.memberQueue.Do(member.User.ID, func() {
+			counterError += applyPrefix(s, nil, false, infos, member)
+		})
+	}
+	return counterMember, counterError
+}
+
+func (r *reconciler) reconcileAndSend(s *discordgo.Session) {
+	counterMember, counterError := r.reconcile(s)
+	log.Println("Reconciliation processed", counterMember, "member(s) with", counterError, "error(s)")
+	if r.messageSender != nil && (counterMember != 0 || counterError != 0) {
+		msg := strings.ReplaceAll(r.msg, countPlaceHolder, strconv.Itoa(counterMember))
+		r.messageSender <- common.MultipartMessage{Message: strings.ReplaceAll(msg, common.NumErrorPlaceHolder, strconv.Itoa(counterError))}
+	}
+}
+
+func (r *reconciler) reconcileEvery(ctx context.Context, s *discordgo.Session, interval time.Duration) {
+	if interval > 0 {
+		for range common.Tick(ctx, interval) {
+			r.reconcileAndSend(s)
+		}
+	}
+}
@@ -27,6 +27,28 @@ import (
 	"github.com/dvaumoron/casiusbot/common"
 )
 
+// reminderModule remind the scheduled events of the guild before they start
+type reminderModule struct {
+	baseModule
+	delays []time.Duration
+	prefix string
+}
+
+func (m *reminderModule) configure(b *bot) bool {
+	b.targetToRef[targetReminderChannel] = b.config.Require(targetReminderChannel)
+	m.delays = b.config.GetDelayMins("REMINDER_BEFORES")
+	m.prefix = buildReminderPrefix(b.config, "REMINDER_TEXT", b.guildId)
+	return true
+}
+
+func (*reminderModule) register(b *bot) {}
+
+func (m *reminderModule) start(b *bot) {
+	ticker := common.LaunchTickers(b.ctx, 1, b.checkInterval)[0]
+	tick := b.loops.register("reminder", b.checkInterval)
+	go remindEvent(b.session, b.guildId, m.delays, b.channelManager.GetTarget(targetReminderChannel), m.prefix, b.startTime, ticker, tick)
+}
+
 func buildReminderPrefix(config common.Config, reminderConfName string, guildId string) string {
 	var reminderBuilder strings.Builder
 	reminderBuilder.WriteString(config.Require(reminderConfName))
@@ -36,8 +58,10 @@ func buildReminderPrefix(config common.Config, reminderConfName string, guildId
 	return reminderBuilder.String()
 }
 
-func remindEvent(session *discordgo.Session, guildId string, delays []time.Duration, messageSender chan<- common.MultipartMessage, reminderPrefix string, previous time.Time, ticker <-chan time.Time) {
+// tick is called at each check of the events (a failing API is not a stalled loop)
+func remindEvent(session *discordgo.Session, guildId string, delays []time.Duration, messageSender chan<- common.MultipartMessage, reminderPrefix string, previous time.Time, ticker <-chan time.Time, tick func()) {
 	for current := range ticker {
+		tick()
 		events, err := session.GuildScheduledEvents(guildId, false)
 		if err != nil {
 			log.Println("Cannot retrieve guild events :", err)
@@ -27,29 +27,103 @@ import (
 	"github.com/dvaumoron/casiusbot/common"
 )
 
-func addRoleCmd(s *discordgo.Session, i *discordgo.InteractionCreate, addedRoleId string, infos common.GuildAndConfInfo, userMonitor *common.IdMonitor) {
-	returnMsg := infos.Msgs.Ok
-	if common.IdInSet(i.Member.Roles, infos.ForbiddenRoleIds) {
-		returnMsg = infos.Msgs.ErrUnauthorized
-	} else if userId := i.Member.User.ID; userId == infos.OwnerId {
-		returnMsg = infos.Msgs.Owner
-	} else if userMonitor.StartProcessing(userId) {
-		defer userMonitor.StopProcessing(userId)
-
-		messageQueue := make(chan common.MultipartMessage, 1)
-		if counterError := addRole(s, messageQueue, true, addedRoleId, infos, i.Member); counterError == 0 {
-			returnMsg = (<-messageQueue).Message
-		} else {
-			returnMsg = strings.ReplaceAll(infos.Msgs.ErrPartial, common.NumErrorPlaceHolder, strconv.Itoa(counterError))
+// roleModule declare the commands to choose a role and the commands to reset them
+type roleModule struct {
+	baseModule
+	roleCmdDesc string
+}
+
+func (m *roleModule) configure(b *bot) bool {
+	m.roleCmdDesc = b.config.Require("DESCRIPTION_ROLE_CMD")
+	if b.cmdConfig["RESET_ALL"].Name != "" {
+		b.requireTarget(targetCmdChannel, cmdChannelProblem)
+	}
+	return true
+}
+
+func (m *roleModule) register(b *bot) {
+	cmdChannelSender := b.cmdChannelSender()
+
+	b.addPublicCmd(helpGroupRoles, b.cmdConfig["RESET"], nil, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		infos := b.infosHolder.Get()
+		addRoleCmd(s, i, infos.DefaultRoleId, infos, &b.memberQueue)
+	})
+	b.addPublicCmd(helpGroupRoles, b.cmdConfig["COUNT"], nil, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		countRoleCmd(s, i, b.infosHolder.Get())
+	})
+
+	infos := b.infosHolder.Get()
+	cmdRoleGroups := make(common.StringSet, len(b.rc.cmdRoleDescs))
+	for _, cmdRoleDesc := range b.rc.cmdRoleDescs {
+		cmdName := cmdRoleDesc.Cmd
+		b.addCmd(helpGroupRoles, common.CmdConf{
+			Name: cmdName, Description: strings.ReplaceAll(m.roleCmdDesc, common.RolePlaceHolder, infos.RoleIdToDisplayName[infos.CmdToRoleId[cmdName]]),
+		}, nil, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			infos := b.infosHolder.Get()
+			addRoleCmd(s, i, infos.CmdToRoleId[cmdName], infos, &b.memberQueue)
+		})
+
+		if group := cmdRoleDesc.Group; group != "" {
+			cmdRoleGroups[group] = common.Empty{}
 		}
 	}
 
-	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-		Type: discordgo.InteractionResponseChannelMessageWithSource,
-		Data: &discordgo.InteractionResponseData{Content: returnMsg},
+	resetAllName := b.cmdConfig["RESET_ALL"].Name
+	b.addBulkCmd(b.cmdConfig["RESET_ALL"], func(s *discordgo.Session) {
+		infos := b.infosHolder.Get()
+		common.ProcessGuildMembers(s, cmdChannelSender, b.guildId, infos.Msgs.ReplaceCmdPlaceHolder(resetAllName), &b.memberQueue, b.snapshotBeforeReset(resetAllName, infos), func(guildMember *discordgo.Member) int {
+			return resetRole(s, infos, guildMember)
+		})
+	})
+
+	resetGroupTemplates := b.cmdConfig["RESET_GROUP"]
+	for group := range cmdRoleGroups {
+		resetGroupConf := resetGroupTemplates
+		resetGroupConf.Name = strings.ReplaceAll(resetGroupTemplates.Name, common.GroupPlaceHolder, group)
+		resetGroupConf.Description = strings.ReplaceAll(resetGroupTemplates.Description, common.GroupPlaceHolder, group)
+		cmdReset := resetGroupConf.Name
+		b.addBulkCmd(resetGroupConf, func(s *discordgo.Session) {
+			infos := b.infosHolder.Get()
+			common.ProcessGuildMembers(s, cmdChannelSender, b.guildId, infos.Msgs.ReplaceCmdPlaceHolder(cmdReset), &b.memberQueue, b.snapshotBeforeReset(cmdReset, infos), func(guildMember *discordgo.Member) int {
+				if common.IdMatch(guildMember.Roles, infos.RoleIdToGroup, group) {
+					return resetRole(s, infos, guildMember)
+				}
+				return 0
+			})
+		})
+	}
+
+	b.addMenu(discordgo.UserApplicationCommand, b.menuConfig["RESET_ROLE"].WithDefaultPermission(b.adminPermission), func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		resetRoleMenu(s, i, &b.memberQueue, b.infosHolder.Get())
 	})
 }
 
+func addRoleCmd(s *discordgo.Session, i *discordgo.InteractionCreate, addedRoleId string, infos common.GuildAndConfInfo, memberQueue *common.MemberQueue) {
+	userId := i.Member.User.ID
+	switch {
+	case addedRoleId == "":
+		// the role has been deleted in the guild
+		common.RespondCmd(s, i, infos, infos.Msgs.ErrGlobal)
+	case common.IdInSet(i.Member.Roles, infos.ForbiddenRoleIds):
+		common.RespondCmd(s, i, infos, infos.Msgs.ErrUnauthorized)
+	case userId == infos.OwnerId:
+		common.RespondCmd(s, i, infos, infos.Msgs.Owner)
+	default:
+		common.DeferCmd(s, i, infos, func() *discordgo.WebhookEdit {
+			returnMsg := infos.Msgs.Ok
+			memberQueue.Do(userId, func() {
+				messageQueue := make(chan common.MultipartMessage, 1)
+				if counterError := addRole(s, messageQueue, true, addedRoleId, infos, i.Member); counterError == 0 {
+					returnMsg = (<-messageQueue).Message
+				} else {
+					returnMsg = strings.ReplaceAll(infos.Msgs.ErrPartial, common.NumErrorPlaceHolder, strconv.Itoa(counterError))
+				}
+			})
+			return &discordgo.WebhookEdit{Content: &returnMsg}
+		})
+	}
+}
+
 func addRole(s *discordgo.Session, messageSender chan<- common.MultipartMessage, forceSend bool, addedRoleId string, infos common.GuildAndConfInfo, member *discordgo.Member) int {
 	toAdd := true
 	counterError := 0
@@ -63,6 +137,7 @@ func addRole(s *discordgo.Session, messageSender chan<- common.MultipartMessage,
 		if _, ok := infos.CmdRoleIds[roleId]; ok {
 			if err := s.GuildMemberRoleRemove(infos.GuildId, userId, roleId); err != nil {
 				log.Println("Prefix role removing failed :", err)
+				common.ApiErrors.Inc("role")
 				counterError++
 			}
 		}
@@ -71,6 +146,7 @@ func addRole(s *discordgo.Session, messageSender chan<- common.MultipartMessage,
 	if toAdd {
 		if err := s.GuildMemberRoleAdd(infos.GuildId, userId, addedRoleId); err != nil {
 			log.Println("Prefix role addition failed :", err)
+			common.ApiErrors.Inc("role")
 			counterError++
 		}
 	}
@@ -79,27 +155,38 @@ func addRole(s *discordgo.Session, messageSender chan<- common.MultipartMessage,
 		counterError += applyPrefix(s, messageSender, forceSend, infos, member)
 	} else {
 		log.Println("Cannot retrieve member :", err)
+		common.ApiErrors.Inc("member")
 		counterError++
 	}
 	return counterError
 }
 
-func countRoleCmd(s *discordgo.Session, i *discordgo.InteractionCreate, roleCountExtracter func([]*discordgo.Member) map[string]int, infos common.GuildAndConfInfo) {
+func countRoleCmd(s *discordgo.Session, i *discordgo.InteractionCreate, infos common.GuildAndConfInfo) {
+	common.DeferCmd(s, i, infos, func() *discordgo.WebhookEdit {
+		returnMsg := countRole(s, infos)
+		return &discordgo.WebhookEdit{Content: &returnMsg}
+	})
+}
+
+func countRole(s *discordgo.Session, infos common.GuildAndConfInfo) string {
 	returnMsg := infos.Msgs.ErrGlobalCmd
-	if guildMembers, err := s.GuildMembers(i.GuildID, "", common.MemberCallLimit); err == nil {
+	if guildMembers, err := s.GuildMembers(infos.GuildId, "", common.MemberCallLimit); err == nil {
+		var roleIdToCount map[string]int
+		if len(infos.CountFilterRoleIds) == 0 {
+			roleIdToCount = extractRoleCount(guildMembers)
+		} else {
+			roleIdToCount = extractRoleCountWithFilter(guildMembers, infos.CountFilterRoleIds)
+		}
+
 		roleNameToCountStr := map[string]string{}
-		for roleId, count := range roleCountExtracter(guildMembers) {
+		for roleId, count := range roleIdToCount {
 			roleNameToCountStr[infos.RoleIdToDisplayName[roleId]] = strconv.Itoa(count)
 		}
 		returnMsg = common.BuildMsgWithNameValueList(infos.Msgs.Count, roleNameToCountStr)
 	} else {
 		log.Println("Cannot retrieve guild members (2) :", err)
 	}
-
-	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
-		Type: discordgo.InteractionResponseChannelMessageWithSource,
-		Data: &discordgo.InteractionResponseData{Content: returnMsg},
-	})
+	return returnMsg
 }
 
 func extractRoleCount(guildMembers []*discordgo.Member) map[string]int {
@@ -125,6 +212,11 @@ func extractRoleCountWithFilter(guildMembers []*discordgo.Member, filterRoleIds
 }
 
 func resetRole(s *discordgo.Session, infos common.GuildAndConfInfo, guildMember *discordgo.Member) int {
+	if infos.DefaultRoleId == "" {
+		// the role has been deleted in the guild
+		return 1
+	}
+
 	userId := guildMember.User.ID
 	if userId != infos.OwnerId && !common.IdInSet(guildMember.Roles, infos.ForbiddenAndIgnoredRoleIds) {
 		return addRole(s, nil, false, infos.DefaultRoleId, infos, guildMember)
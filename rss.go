@@ -19,10 +19,17 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"log"
+	"os"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/bwmarrin/discordgo"
 	"github.com/dvaumoron/casiusbot/common"
+	"github.com/dvaumoron/casiusbot/deepl"
 	"github.com/mmcdole/gofeed"
 )
 
@@ -31,56 +38,266 @@ type linkInfo struct {
 	description string
 }
 
-func bgReadMultipleRSS(messageSender chan<- common.MultipartMessage, feeds []any, translater Translater, startTime time.Time, tickers []chan time.Time) {
-	if len(feeds) == 0 {
-		return
+// feedConf is a feed from FEEDS, or from FEEDS_PATH once edited from the admin dashboard
+type feedConf struct {
+	URL               string `json:"url"`
+	TranslateSelector string `json:"translateSelector,omitempty"`
+	Checker           string `json:"checker,omitempty"`
+}
+
+// feedModule post the new items of the feeds (translated when DEEPL_TOKEN is set)
+type feedModule struct {
+	translater Translater
+}
+
+func (m *feedModule) configure(b *bot) bool {
+	config := b.config
+	feedsPath, feeds := readFeeds(config)
+	// with FEEDS_PATH, the feeds can be added later
+	if len(feeds) == 0 && feedsPath == "" {
+		return false
 	}
 
-	defaultLinkSender := createLinkSender(messageSender)
-	for index, feed := range feeds {
+	b.targetToRef[targetNewsChannel] = config.Require(targetNewsChannel)
+	if deepLToken := config.GetString("DEEPL_TOKEN"); deepLToken != "" {
+		deepLUrl := config.Require("DEEPL_API_URL")
+		sourceLang := config.GetString("TRANSLATE_SOURCE_LANG")
+		targetLang := config.Require("TRANSLATE_TARGET_LANG")
+		messageError := config.Require("MESSAGE_TRANSLATE_ERROR")
+		messageLimit := config.Require("MESSAGE_TRANSLATE_LIMIT")
+		m.translater = deepl.MakeClient(deepLUrl, deepLToken, sourceLang, targetLang, messageError, messageLimit)
+	}
+	b.feeds = &feedManager{path: feedsPath, feeds: feeds, urlToCancel: map[string]context.CancelFunc{}}
+	return true
+}
+
+func (m *feedModule) register(b *bot) {
+	if translater := m.translater; translater != nil {
+		b.addMenu(discordgo.MessageApplicationCommand, b.menuConfig["TRANSLATE"], func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+			translateMenu(s, i, translater, b.infosHolder.Get())
+		})
+	}
+}
+
+func (m *feedModule) start(b *bot) {
+	b.feeds.start(b.ctx, b.channelManager.GetTarget(targetNewsChannel), m.translater, b.checkInterval, &b.workers, b.loops, b.startTime)
+}
+
+func (m *feedModule) stop(b *bot) {
+	b.feeds.stop()
+}
+
+// the FEEDS_PATH file take precedence over FEEDS
+func readFeeds(config common.Config) (string, []feedConf) {
+	feedsPath := config.GetPath("FEEDS_PATH")
+	if feedsPath != "" {
+		data, err := os.ReadFile(feedsPath)
+		if err == nil {
+			var feeds []feedConf
+			if err = json.Unmarshal(data, &feeds); err == nil {
+				return feedsPath, feeds
+			}
+			log.Println("Parsing saved feeds failed :", err)
+		} else if !os.IsNotExist(err) {
+			log.Println("Loading saved feeds failed :", err)
+		}
+	}
+
+	var feeds []feedConf
+	for _, feed := range config.GetSlice("FEEDS") {
 		if casted, ok := feed.(map[string]any); ok {
 			if feedURL, _ := casted["URL"].(string); feedURL != "" {
 				selector, _ := casted["TRANSLATE_SELECTOR"].(string)
 				checkRule, _ := casted["CHECKER"].(string)
-				filteringSender := initLinkSender(messageSender, selector, translater, defaultLinkSender)
-				checkLink := common.InitChecker(checkRule)
-				go startReadRSS(filteringSender, feedURL, checkLink, startTime, tickers[index])
+				feeds = append(feeds, feedConf{URL: feedURL, TranslateSelector: selector, Checker: checkRule})
 			}
 		}
 	}
+	return feedsPath, feeds
 }
 
-func initLinkSender(messageSender chan<- common.MultipartMessage, selector string, translater Translater, defaultLinkSender chan<- linkInfo) chan<- linkInfo {
-	if selector == "" || translater == nil {
-		return defaultLinkSender
+// feedManager run a reader by feed, the feeds can be changed at runtime when FEEDS_PATH is set
+type feedManager struct {
+	path        string
+	feeds       []feedConf
+	urlToCancel map[string]context.CancelFunc
+	mutex       sync.Mutex
+
+	// set by start
+	ctx               context.Context
+	messageSender     chan<- common.MultipartMessage
+	translater        Translater
+	interval          time.Duration
+	defaultLinkSender chan<- linkInfo
+	workers           *sync.WaitGroup
+	loops             *loopMonitor
+	readers           sync.WaitGroup
+}
+
+func (m *feedManager) start(ctx context.Context, messageSender chan<- common.MultipartMessage, translater Translater, interval time.Duration, workers *sync.WaitGroup, loops *loopMonitor, startTime time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.ctx, m.messageSender, m.translater, m.interval, m.workers, m.loops = ctx, messageSender, translater, interval, workers, loops
+	m.defaultLinkSender = createLinkSender(messageSender, workers)
+	for _, feed := range m.feeds {
+		m.launch(feed, startTime)
+	}
+}
+
+// the readers stop when their ticker is closed, then the link senders are closed
+// (the workers end once the links already read are sent, with their translation)
+func (m *feedManager) stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// no reader is launched after the cancellation of the context
+	if m.defaultLinkSender != nil {
+		go closeLinkSender(&m.readers, m.defaultLinkSender)
+	}
+}
+
+func closeLinkSender(readers *sync.WaitGroup, linkSender chan<- linkInfo) {
+	readers.Wait()
+	close(linkSender)
+}
+
+// must be called with the mutex locked
+func (m *feedManager) launch(feed feedConf, startTime time.Time) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	m.urlToCancel[feed.URL] = cancel
 
+	linkSender := initLinkSender(m.messageSender, feed.TranslateSelector, m.translater, m.defaultLinkSender, m.workers)
+	checkLink := common.InitChecker(feed.Checker)
+	tick := m.loops.register("rss "+feed.URL, m.interval)
+	ticker := common.LaunchTickers(ctx, 1, m.interval)[0]
+	m.readers.Add(1)
+	go func() {
+		defer m.readers.Done()
+		startReadRSS(linkSender, feed.URL, checkLink, startTime, ticker, tick)
+		if linkSender != m.defaultLinkSender {
+			close(linkSender)
+		}
+	}()
+}
+
+// must be called with the mutex locked
+func (m *feedManager) cancel(feedURL string) {
+	if cancel, ok := m.urlToCancel[feedURL]; ok {
+		cancel()
+		delete(m.urlToCancel, feedURL)
+		m.loops.unregister("rss " + feedURL)
 	}
-	return bgAddTranslationFilter(messageSender, selector, translater)
+}
 
+func (m *feedManager) editable() bool {
+	return m.path != ""
+}
+
+func (m *feedManager) list() []feedConf {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return slices.Clone(m.feeds)
+}
+
+// add the feed or replace the one with the same URL (only the new items are posted),
+// return false when the feeds are not editable or when the save failed (the change is still applied)
+func (m *feedManager) set(feed feedConf) bool {
+	if !m.editable() {
+		return false
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if index := m.indexOf(feed.URL); index == -1 {
+		m.feeds = append(m.feeds, feed)
+	} else {
+		m.feeds[index] = feed
+	}
+	if m.ctx != nil && m.ctx.Err() == nil {
+		m.cancel(feed.URL)
+		m.launch(feed, time.Now())
+	}
+	return m.save()
+}
+
+// return false when the feeds are not editable, when the feed is unknown or when the save failed
+func (m *feedManager) remove(feedURL string) bool {
+	if !m.editable() {
+		return false
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	index := m.indexOf(feedURL)
+	if index == -1 {
+		return false
+	}
+	m.feeds = slices.Delete(m.feeds, index, index+1)
+	if m.ctx != nil {
+		m.cancel(feedURL)
+	}
+	return m.save()
+}
+
+func (m *feedManager) indexOf(feedURL string) int {
+	return slices.IndexFunc(m.feeds, func(feed feedConf) bool {
+		return feed.URL == feedURL
+	})
+}
+
+// must be called with the mutex locked
+func (m *feedManager) save() bool {
+	data, err := json.Marshal(m.feeds)
+	if err == nil {
+		if err = os.WriteFile(m.path, data, 0644); err == nil {
+			return true
+		}
+		log.Println("Fail to save feeds :", err)
+	} else {
+		log.Println("Fail to marshal feeds :", err)
+	}
+	return false
+}
+
+func initLinkSender(messageSender chan<- common.MultipartMessage, selector string, translater Translater, defaultLinkSender chan<- linkInfo, workers *sync.WaitGroup) chan<- linkInfo {
+	if selector == "" || translater == nil {
+		return defaultLinkSender
+	}
+	return bgAddTranslationFilter(messageSender, selector, translater, workers)
 }
 
-func createLinkSender(messageSender chan<- common.MultipartMessage) chan<- linkInfo {
+func createLinkSender(messageSender chan<- common.MultipartMessage, workers *sync.WaitGroup) chan<- linkInfo {
 	linkChan := make(chan linkInfo)
-	go sendLink(messageSender, linkChan)
+	workers.Add(1)
+	go sendLink(messageSender, linkChan, workers)
 	return linkChan
 }
 
-func sendLink(messageSender chan<- common.MultipartMessage, linkReceiver <-chan linkInfo) {
+func sendLink(messageSender chan<- common.MultipartMessage, linkReceiver <-chan linkInfo, workers *sync.WaitGroup) {
+	defer workers.Done()
 	for info := range linkReceiver {
 		messageSender <- common.MultipartMessage{Message: info.link}
 	}
 }
 
-func startReadRSS(linkSender chan<- linkInfo, feedURL string, checkLink func(string) bool, previous time.Time, ticker <-chan time.Time) {
+func startReadRSS(linkSender chan<- linkInfo, feedURL string, checkLink func(string) bool, previous time.Time, ticker <-chan time.Time, tick func()) {
 	fp := gofeed.NewParser()
 	for range ticker {
+		// the fetch errors are reported by the metrics, a failing feed is not a stalled loop
+		tick()
 		previous = readRSS(linkSender, fp, feedURL, checkLink, previous)
 	}
 }
 
 func readRSS(linkSender chan<- linkInfo, fp *gofeed.Parser, feedURL string, checkLink func(string) bool, after time.Time) time.Time {
 	var lastPublished time.Time
-	if feed, err := fp.ParseURL(feedURL); err == nil {
+	start := time.Now()
+	feed, err := fp.ParseURL(feedURL)
+	common.RssFetchDurations.ObserveDuration(feedURL, start)
+	if err == nil {
 		for _, item := range feed.Items {
 			published := item.PublishedParsed
 			if published == nil || published.IsZero() {
@@ -89,6 +306,7 @@ func readRSS(linkSender chan<- linkInfo, fp *gofeed.Parser, feedURL string, chec
 				if published.After(after) {
 					if checkLink(item.Link) {
 						linkSender <- linkInfo{link: item.Link, description: item.Description}
+						common.ItemsPosted.Inc(feedURL)
 					} else {
 						log.Println("Rejected link : ", item.Link)
 					}
@@ -100,6 +318,7 @@ func readRSS(linkSender chan<- linkInfo, fp *gofeed.Parser, feedURL string, chec
 		}
 	} else {
 		log.Println("RSS parsing failed :", err)
+		common.RssFetchErrors.Inc(feedURL)
 	}
 	if lastPublished.IsZero() {
 		lastPublished = after
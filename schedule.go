@@ -0,0 +1,297 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+// one-off date format (in local time)
+const scheduleDateFormat = "2006-01-02 15:04"
+
+var errPastDate = errors.New("date already passed")
+
+type scheduledCmd struct {
+	Cmd  string `json:"cmd"`
+	When string `json:"when"`
+	// not saved, config schedules are read at each startup
+	fromConfig bool
+	once       bool
+	match      func(time.Time) bool
+}
+
+func parseSchedule(cmdName string, when string, fromConfig bool) (scheduledCmd, error) {
+	sc := scheduledCmd{Cmd: cmdName, When: when, fromConfig: fromConfig}
+	if date, err := time.ParseInLocation(scheduleDateFormat, when, time.Local); err == nil {
+		sc.once = true
+		sc.match = date.Equal
+		if date.Before(time.Now()) {
+			return sc, fmt.Errorf("%w : %v", errPastDate, when)
+		}
+		return sc, nil
+	}
+
+	matcher, err := common.ParseCron(when)
+	if err != nil {
+		return sc, err
+	}
+	sc.match = matcher.Match
+	return sc, nil
+}
+
+// scheduleModule must be declared after the modules with bulk commands
+type scheduleModule struct {
+	baseModule
+	cmdScheduler *scheduler
+}
+
+func (*scheduleModule) configure(b *bot) bool {
+	return true
+}
+
+func (m *scheduleModule) register(b *bot) {
+	m.cmdScheduler = makeScheduler(b.config, b.config.GetPath("SCHEDULES_PATH"), b.bulkCmds)
+	if len(b.bulkCmds) == 0 {
+		return
+	}
+
+	bulkCmdChoices := make([]*discordgo.ApplicationCommandOptionChoice, 0, len(b.bulkCmds))
+	for cmdName := range b.bulkCmds {
+		bulkCmdChoices = append(bulkCmdChoices, &discordgo.ApplicationCommandOptionChoice{Name: cmdName, Value: cmdName})
+	}
+	slices.SortFunc(bulkCmdChoices, cmpChoiceNameAsc)
+
+	scheduleParams := []*discordgo.ApplicationCommandOption{{
+		Type: discordgo.ApplicationCommandOptionString, Name: "command",
+		Description: b.config.Require("PARAMETER_DESCRIPTION_SCHEDULE_CMD_1"), Required: true, Choices: bulkCmdChoices,
+	}, {
+		Type: discordgo.ApplicationCommandOptionString, Name: "when",
+		Description: b.config.Require("PARAMETER_DESCRIPTION_SCHEDULE_CMD_2"),
+	}}
+	b.addAdminCmd(helpGroupSchedule, "SCHEDULE", scheduleParams, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		m.cmdScheduler.scheduleCmd(s, i, b.infosHolder.Get())
+	})
+	displayScheduleMsg := b.config.GetString("MESSAGE_SCHEDULE_DISPLAY")
+	b.addAdminCmd(helpGroupSchedule, "DISPLAY_SCHEDULE", nil, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		m.cmdScheduler.displayScheduleCmd(s, i, displayScheduleMsg, b.infosHolder.Get())
+	})
+}
+
+func (m *scheduleModule) start(b *bot) {
+	if len(b.bulkCmds) != 0 {
+		go m.cmdScheduler.run(b.ctx, b.session)
+	}
+}
+
+// scheduler launch the bulk commands at the scheduled times (checked every minute)
+type scheduler struct {
+	schedulesPath string
+	bulkCmds      map[string]func(*discordgo.Session)
+	schedules     []scheduledCmd
+	mutex         sync.Mutex
+}
+
+func makeScheduler(config common.Config, schedulesPath string, bulkCmds map[string]func(*discordgo.Session)) *scheduler {
+	sr := &scheduler{schedulesPath: schedulesPath, bulkCmds: bulkCmds}
+	for _, confSchedule := range config.GetSlice("SCHEDULES") {
+		casted, ok := confSchedule.(map[string]any)
+		if !ok {
+			panic("Malformed schedule")
+		}
+
+		cmdName, _ := casted["CMD"].(string)
+		when, _ := casted["WHEN"].(string)
+		if _, ok := bulkCmds[cmdName]; !ok {
+			panic("Schedule with an unknown command : " + cmdName)
+		}
+		sc, err := parseSchedule(cmdName, when, true)
+		if errors.Is(err, errPastDate) {
+			// already launched before a restart
+			log.Println("Schedule from configuration ignored :", err)
+			continue
+		}
+		if err != nil {
+			panic(fmt.Sprint("Schedule parsing failed for ", cmdName, " : ", err))
+		}
+		sr.schedules = append(sr.schedules, sc)
+	}
+
+	if schedulesPath != "" {
+		data, err := os.ReadFile(schedulesPath)
+		if err != nil {
+			log.Println("Loading saved schedules failed :", err)
+			return sr
+		}
+
+		var saved []scheduledCmd
+		if err = json.Unmarshal(data, &saved); err != nil {
+			log.Println("Parsing saved schedules failed :", err)
+			return sr
+		}
+		for _, savedSchedule := range saved {
+			if _, ok := bulkCmds[savedSchedule.Cmd]; !ok {
+				log.Println("Saved schedule with an unknown command ignored :", savedSchedule.Cmd)
+				continue
+			}
+			sc, err := parseSchedule(savedSchedule.Cmd, savedSchedule.When, false)
+			if err != nil {
+				log.Println("Saved schedule ignored :", err)
+				continue
+			}
+			sr.schedules = append(sr.schedules, sc)
+		}
+	}
+	return sr
+}
+
+func (sr *scheduler) run(ctx context.Context, session *discordgo.Session) {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next.Sub(now)):
+			sr.launch(session, next)
+		}
+	}
+}
+
+func (sr *scheduler) launch(session *discordgo.Session, current time.Time) {
+	sr.mutex.Lock()
+	defer sr.mutex.Unlock()
+
+	kept := sr.schedules[:0]
+	changed := false
+	for _, sc := range sr.schedules {
+		if sc.match(current) {
+			log.Println("Launching scheduled command :", sc.Cmd)
+			go sr.bulkCmds[sc.Cmd](session)
+			if sc.once {
+				changed = true
+				continue
+			}
+		}
+		kept = append(kept, sc)
+	}
+	sr.schedules = kept
+	if changed {
+		sr.save()
+	}
+}
+
+// should be called with the lock
+func (sr *scheduler) save() error {
+	if sr.schedulesPath == "" {
+		return nil
+	}
+
+	saved := make([]scheduledCmd, 0, len(sr.schedules))
+	for _, sc := range sr.schedules {
+		if !sc.fromConfig {
+			saved = append(saved, sc)
+		}
+	}
+
+	data, err := json.Marshal(saved)
+	if err == nil {
+		err = os.WriteFile(sr.schedulesPath, data, 0o644)
+	}
+	if err != nil {
+		log.Println("Fail to save schedules :", err)
+	}
+	return err
+}
+
+func (sr *scheduler) scheduleCmd(s *discordgo.Session, i *discordgo.InteractionCreate, infos common.GuildAndConfInfo) {
+	common.AuthorizedCmd(s, i, infos, func() string {
+		options := i.ApplicationCommandData().Options
+		optionsLen := len(options)
+		if optionsLen == 0 {
+			return infos.Msgs.ErrGlobal
+		}
+
+		cmdName := options[0].StringValue()
+		if _, ok := sr.bulkCmds[cmdName]; !ok {
+			return infos.Msgs.ErrGlobal
+		}
+		when := ""
+		if optionsLen > 1 {
+			when = strings.TrimSpace(options[1].StringValue())
+		}
+
+		sr.mutex.Lock()
+		defer sr.mutex.Unlock()
+		if when == "" {
+			// delete the schedules added by command
+			kept := sr.schedules[:0]
+			for _, sc := range sr.schedules {
+				if sc.fromConfig || sc.Cmd != cmdName {
+					kept = append(kept, sc)
+				}
+			}
+			sr.schedules = kept
+		} else {
+			sc, err := parseSchedule(cmdName, when, false)
+			if err != nil {
+				log.Println("Schedule parsing failed :", err)
+				return infos.Msgs.ErrGlobal
+			}
+			sr.schedules = append(sr.schedules, sc)
+		}
+
+		if sr.save() != nil {
+			return infos.Msgs.ErrGlobal
+		}
+		return infos.Msgs.Ok
+	})
+}
+
+func (sr *scheduler) displayScheduleCmd(s *discordgo.Session, i *discordgo.InteractionCreate, baseMsg string, infos common.GuildAndConfInfo) {
+	common.AuthorizedCmd(s, i, infos, func() string {
+		sr.mutex.Lock()
+		defer sr.mutex.Unlock()
+
+		var buffer strings.Builder
+		buffer.WriteString(baseMsg)
+		for _, sc := range sr.schedules {
+			buffer.WriteByte('\n')
+			buffer.WriteString(sc.Cmd)
+			buffer.WriteString(" = ")
+			buffer.WriteString(sc.When)
+		}
+		return buffer.String()
+	})
+}
+
+func cmpChoiceNameAsc(a *discordgo.ApplicationCommandOptionChoice, b *discordgo.ApplicationCommandOptionChoice) int {
+	return strings.Compare(a.Name, b.Name)
+}
@@ -0,0 +1,367 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+const (
+	snapshotExt        = ".json"
+	snapshotDateFormat = "20060102-150405"
+	diffFileName       = "diff.txt"
+)
+
+var errSnapshotName = errors.New("invalid snapshot name")
+
+type memberSnapshot struct {
+	Name    string   `json:"name"`
+	Nick    string   `json:"nick"`
+	RoleIds []string `json:"roleIds"`
+}
+
+type snapshot struct {
+	Date    time.Time                 `json:"date"`
+	Cmd     string                    `json:"cmd"`
+	Members map[string]memberSnapshot `json:"members"`
+}
+
+type snapshotStore struct {
+	dirPath string
+}
+
+type snapshotModule struct {
+	baseModule
+}
+
+func (snapshotModule) configure(b *bot) bool {
+	snapshotDirPath := b.config.GetPath("SNAPSHOT_DIR_PATH")
+	if snapshotDirPath == "" {
+		return false
+	}
+
+	if err := os.MkdirAll(snapshotDirPath, 0o755); err != nil {
+		panic(fmt.Sprint("Cannot create the snapshot directory :", err))
+	}
+	b.snapshots = &snapshotStore{dirPath: snapshotDirPath}
+
+	if b.cmdConfig["DIFF_SNAPSHOT"].Name != "" || b.cmdConfig["RESTORE_SNAPSHOT"].Name != "" {
+		b.requireTarget(targetCmdChannel, cmdChannelProblem)
+	}
+	return true
+}
+
+func (snapshotModule) register(b *bot) {
+	config := b.config
+	store := *b.snapshots
+	cmdChannelSender := b.cmdChannelSender()
+
+	listSnapshotMsg := config.GetString("MESSAGE_SNAPSHOT_LIST")
+	b.addAdminCmd(helpGroupSnapshot, "LIST_SNAPSHOT", nil, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		listSnapshotCmd(s, i, store, listSnapshotMsg, b.infosHolder.Get())
+	})
+
+	snapshotParams := []*discordgo.ApplicationCommandOption{{
+		Type: discordgo.ApplicationCommandOptionString, Name: "snapshot",
+		Description: config.Require("PARAMETER_DESCRIPTION_SNAPSHOT_CMD_1"), Required: true,
+	}}
+	diffSnapshotMsg := config.GetString("MESSAGE_SNAPSHOT_DIFF")
+	noDiffSnapshotMsg := config.GetString("MESSAGE_SNAPSHOT_NO_DIFF")
+	leftSnapshotMsg := config.GetString("MESSAGE_SNAPSHOT_LEFT")
+	nickSnapshotMsg := config.GetString("MESSAGE_SNAPSHOT_NICK")
+	b.addAdminCmd(helpGroupSnapshot, "DIFF_SNAPSHOT", snapshotParams, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		diffSnapshotCmd(s, i, store, cmdChannelSender, diffSnapshotMsg, noDiffSnapshotMsg, leftSnapshotMsg, nickSnapshotMsg, b.infosHolder.Get())
+	})
+
+	var restoreSnapshotName string
+	restoreSnapshotName = b.addAdminCmd(helpGroupSnapshot, "RESTORE_SNAPSHOT", append(snapshotParams, &discordgo.ApplicationCommandOption{
+		Type: discordgo.ApplicationCommandOptionUser, Name: "user", Description: config.Require("PARAMETER_DESCRIPTION_SNAPSHOT_CMD_2"),
+	}, &discordgo.ApplicationCommandOption{
+		Type: discordgo.ApplicationCommandOptionRole, Name: "role", Description: config.Require("PARAMETER_DESCRIPTION_SNAPSHOT_CMD_3"),
+	}), func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		restoreSnapshotCmd(s, i, store, cmdChannelSender, restoreSnapshotName, &b.memberQueue, b.infosHolder.Get())
+	})
+}
+
+// a nil preparation disable the snapshot before reset
+func (b *bot) snapshotBeforeReset(cmdName string, infos common.GuildAndConfInfo) func([]*discordgo.Member) error {
+	if b.snapshots == nil {
+		return nil
+	}
+	store := *b.snapshots
+	return func(guildMembers []*discordgo.Member) error {
+		return store.save(cmdName, infos, guildMembers)
+	}
+}
+
+// the managed roles are the ones changed by the reset commands
+func isManagedRole(roleId string, infos common.GuildAndConfInfo) bool {
+	_, ok := infos.RoleIdToPrefix[roleId]
+	return ok || roleId == infos.DefaultRoleId
+}
+
+func (store snapshotStore) save(cmdName string, infos common.GuildAndConfInfo, guildMembers []*discordgo.Member) error {
+	now := time.Now()
+	snap := snapshot{Date: now, Cmd: cmdName, Members: make(map[string]memberSnapshot, len(guildMembers))}
+	for _, member := range guildMembers {
+		roleIds := []string{}
+		for _, roleId := range member.Roles {
+			if isManagedRole(roleId, infos) {
+				roleIds = append(roleIds, roleId)
+			}
+		}
+		snap.Members[member.User.ID] = memberSnapshot{Name: common.ExtractNick(member), Nick: member.Nick, RoleIds: roleIds}
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	snapshotPath := filepath.Join(store.dirPath, now.Format(snapshotDateFormat)+"-"+cmdName+snapshotExt)
+	return os.WriteFile(snapshotPath, data, 0o644)
+}
+
+func (store snapshotStore) list() ([]string, error) {
+	entries, err := os.ReadDir(store.dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if fileName := entry.Name(); !entry.IsDir() && strings.HasSuffix(fileName, snapshotExt) {
+			names = append(names, fileName[:len(fileName)-len(snapshotExt)])
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func (store snapshotStore) load(name string) (snapshot, error) {
+	var snap snapshot
+	if name == "" || filepath.Base(name) != name {
+		return snap, errSnapshotName
+	}
+
+	data, err := os.ReadFile(filepath.Join(store.dirPath, name+snapshotExt))
+	if err != nil {
+		return snap, err
+	}
+	err = json.Unmarshal(data, &snap)
+	return snap, err
+}
+
+func listSnapshotCmd(s *discordgo.Session, i *discordgo.InteractionCreate, store snapshotStore, baseMsg string, infos common.GuildAndConfInfo) {
+	common.AuthorizedCmd(s, i, infos, func() string {
+		names, err := store.list()
+		if err != nil {
+			log.Println("Cannot list snapshots :", err)
+			return infos.Msgs.ErrGlobal
+		}
+
+		var buffer strings.Builder
+		buffer.WriteString(baseMsg)
+		for _, name := range names {
+			buffer.WriteByte('\n')
+			buffer.WriteString(name)
+		}
+		return buffer.String()
+	})
+}
+
+func diffSnapshotCmd(s *discordgo.Session, i *discordgo.InteractionCreate, store snapshotStore, messageSender chan<- common.MultipartMessage, baseMsg string, noDiffMsg string, leftMsg string, nickMsg string, infos common.GuildAndConfInfo) {
+	common.AuthorizedCmd(s, i, infos, func() string {
+		name, _, _ := readSnapshotOptions(i)
+		snap, err := store.load(name)
+		if err != nil {
+			log.Println("Cannot load snapshot :", err)
+			return infos.Msgs.ErrGlobal
+		}
+
+		go sendSnapshotDiff(s, snap, messageSender, baseMsg, noDiffMsg, leftMsg, nickMsg, infos)
+		return infos.Msgs.Ok
+	})
+}
+
+func sendSnapshotDiff(s *discordgo.Session, snap snapshot, messageSender chan<- common.MultipartMessage, baseMsg string, noDiffMsg string, leftMsg string, nickMsg string, infos common.GuildAndConfInfo) {
+	guildMembers, err := s.GuildMembers(infos.GuildId, "", common.MemberCallLimit)
+	if err != nil {
+		log.Println("Cannot retrieve guild members (7) :", err)
+		messageSender <- common.MultipartMessage{Message: infos.Msgs.ErrGlobal}
+		return
+	}
+
+	idToMember := make(map[string]*discordgo.Member, len(guildMembers))
+	for _, member := range guildMembers {
+		idToMember[member.User.ID] = member
+	}
+
+	var diffs []string
+	for userId, memberSnap := range snap.Members {
+		member, ok := idToMember[userId]
+		if !ok {
+			diffs = append(diffs, strings.ReplaceAll(leftMsg, common.UserPlaceHolder, memberSnap.Name))
+			continue
+		}
+
+		var buffer strings.Builder
+		if nick := cleanPrefixInNick(member.Nick, infos.Prefixes); nick != cleanPrefixInNick(memberSnap.Nick, infos.Prefixes) {
+			buffer.WriteByte(' ')
+			buffer.WriteString(strings.ReplaceAll(strings.ReplaceAll(nickMsg, "{{old}}", memberSnap.Nick), "{{new}}", member.Nick))
+		}
+		for _, roleId := range memberSnap.RoleIds {
+			if !slices.Contains(member.Roles, roleId) {
+				buffer.WriteString(" -")
+				buffer.WriteString(roleName(roleId, infos))
+			}
+		}
+		for _, roleId := range member.Roles {
+			if isManagedRole(roleId, infos) && !slices.Contains(memberSnap.RoleIds, roleId) {
+				buffer.WriteString(" +")
+				buffer.WriteString(roleName(roleId, infos))
+			}
+		}
+		if buffer.Len() != 0 {
+			diffs = append(diffs, memberSnap.Name+" :"+buffer.String())
+		}
+	}
+
+	if len(diffs) == 0 {
+		messageSender <- common.MultipartMessage{Message: noDiffMsg}
+		return
+	}
+
+	slices.Sort(diffs)
+	messageSender <- common.MultipartMessage{
+		Message: baseMsg, FileName: diffFileName, FileData: strings.Join(diffs, "\n"), AllowMerge: true,
+	}
+}
+
+func restoreSnapshotCmd(s *discordgo.Session, i *discordgo.InteractionCreate, store snapshotStore, messageSender chan<- common.MultipartMessage, cmdName string, memberQueue *common.MemberQueue, infos common.GuildAndConfInfo) {
+	common.AuthorizedCmd(s, i, infos, func() string {
+		msgs := infos.Msgs.ReplaceCmdPlaceHolder(cmdName)
+		name, filterUserId, filterRoleId := readSnapshotOptions(i)
+		snap, err := store.load(name)
+		if err != nil {
+			log.Println("Cannot load snapshot (2) :", err)
+			return infos.Msgs.ErrGlobal
+		}
+
+		go common.ProcessGuildMembers(s, messageSender, infos.GuildId, msgs, memberQueue, nil, func(member *discordgo.Member) int {
+			memberSnap, ok := snap.Members[member.User.ID]
+			if !ok || (filterUserId != "" && member.User.ID != filterUserId) || (filterRoleId != "" && !slices.Contains(member.Roles, filterRoleId)) {
+				return 0
+			}
+			return restoreMember(s, memberSnap, infos, member)
+		})
+		return msgs.Ok
+	})
+}
+
+func restoreMember(s *discordgo.Session, memberSnap memberSnapshot, infos common.GuildAndConfInfo, member *discordgo.Member) int {
+	userId := member.User.ID
+	if userId == infos.OwnerId || common.IdInSet(member.Roles, infos.ForbiddenAndIgnoredRoleIds) {
+		return 0
+	}
+
+	counterError := 0
+	if snapNick := cleanPrefixInNick(memberSnap.Nick, infos.Prefixes); cleanPrefixInNick(member.Nick, infos.Prefixes) != snapNick {
+		// the prefix is added back by applyPrefix
+		if err := s.GuildMemberNickname(infos.GuildId, userId, snapNick); err != nil {
+			log.Println("Nickname change failed (3) :", err)
+			common.ApiErrors.Inc("nickname")
+			counterError++
+		}
+	}
+
+	cmdRoleId := ""
+	for _, roleId := range memberSnap.RoleIds {
+		if _, ok := infos.CmdRoleIds[roleId]; ok {
+			// addRole manage the exclusivity of command roles
+			cmdRoleId = roleId
+			continue
+		}
+		// ignore the roles deleted since the snapshot
+		if _, ok := infos.RoleIdToDisplayName[roleId]; ok && !slices.Contains(member.Roles, roleId) {
+			if err := s.GuildMemberRoleAdd(infos.GuildId, userId, roleId); err != nil {
+				log.Println("Role addition failed (2) :", err)
+				common.ApiErrors.Inc("role")
+				counterError++
+			}
+		}
+	}
+	for _, roleId := range member.Roles {
+		if _, ok := infos.CmdRoleIds[roleId]; ok && cmdRoleId != "" {
+			continue
+		}
+		if isManagedRole(roleId, infos) && !slices.Contains(memberSnap.RoleIds, roleId) {
+			if err := s.GuildMemberRoleRemove(infos.GuildId, userId, roleId); err != nil {
+				log.Println("Role removing failed (3) :", err)
+				common.ApiErrors.Inc("role")
+				counterError++
+			}
+		}
+	}
+
+	if cmdRoleId != "" {
+		return counterError + addRole(s, nil, false, cmdRoleId, infos, member)
+	}
+
+	if member, err := s.GuildMember(infos.GuildId, userId); err == nil {
+		counterError += applyPrefix(s, nil, false, infos, member)
+	} else {
+		log.Println("Cannot retrieve member (2) :", err)
+		common.ApiErrors.Inc("member")
+		counterError++
+	}
+	return counterError
+}
+
+func readSnapshotOptions(i *discordgo.InteractionCreate) (name string, userId string, roleId string) {
+	for _, option := range i.ApplicationCommandData().Options {
+		switch option.Type {
+		case discordgo.ApplicationCommandOptionString:
+			name = option.StringValue()
+		case discordgo.ApplicationCommandOptionUser:
+			userId = option.UserValue(nil).ID
+		case discordgo.ApplicationCommandOptionRole:
+			roleId = option.RoleValue(nil, "").ID
+		}
+	}
+	return
+}
+
+func roleName(roleId string, infos common.GuildAndConfInfo) string {
+	if name, ok := infos.RoleIdToDisplayName[roleId]; ok {
+		return name
+	}
+	return roleId
+}
@@ -0,0 +1,194 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+type stickyMember struct {
+	Nick    string    `json:"nick"`
+	RoleIds []string  `json:"roleIds"`
+	LeftAt  time.Time `json:"leftAt"`
+}
+
+type stickyModule struct {
+	baseModule
+}
+
+func (stickyModule) configure(b *bot) bool {
+	stickyPath := b.config.GetPath("STICKY_PATH")
+	if stickyPath == "" {
+		return false
+	}
+
+	b.stickies = makeStickyStore(stickyPath, b.config.GetDurationDay("STICKY_RETENTION"))
+	return true
+}
+
+// the returning members are managed in the join pipeline
+func (stickyModule) register(b *bot) {
+	b.onMemberRemove(func(s *discordgo.Session, user *discordgo.User, state memberState, seen bool) {
+		// an empty entry would replace the joining role on return
+		if seen {
+			b.stickies.remember(user.ID, state, b.infosHolder.Get())
+		}
+	})
+}
+
+// stickyStore keep the managed roles and the nickname (without prefix) of the members who left the guild
+type stickyStore struct {
+	path       string
+	retention  time.Duration // no limit when not positive
+	idToMember map[string]stickyMember
+	mutex      sync.Mutex
+}
+
+func makeStickyStore(path string, retention time.Duration) *stickyStore {
+	store := &stickyStore{path: path, retention: retention, idToMember: map[string]stickyMember{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Loading sticky data failed :", err)
+		}
+		return store
+	}
+
+	if err = json.Unmarshal(data, &store.idToMember); err != nil {
+		log.Println("Parsing sticky data failed :", err)
+	}
+	return store
+}
+
+func (store *stickyStore) expired(member stickyMember, now time.Time) bool {
+	return store.retention > 0 && now.Sub(member.LeftAt) > store.retention
+}
+
+// forbidden roles are kept too, to not allow to escape them by leaving the guild
+func (store *stickyStore) remember(userId string, state memberState, infos common.GuildAndConfInfo) {
+	roleIds := []string{}
+	for _, roleId := range state.roleIds {
+		if _, ok := infos.ForbiddenRoleIds[roleId]; ok || isManagedRole(roleId, infos) {
+			roleIds = append(roleIds, roleId)
+		}
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.idToMember[userId] = stickyMember{
+		Nick: cleanPrefixInNick(state.nick, infos.Prefixes), RoleIds: roleIds, LeftAt: time.Now(),
+	}
+	store.save()
+}
+
+// remove and return the data of a returning member (ok is false when there is no data or when they are too old)
+func (store *stickyStore) pop(userId string) (stickyMember, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	member, ok := store.idToMember[userId]
+	if !ok {
+		return member, false
+	}
+	delete(store.idToMember, userId)
+	store.save()
+	return member, !store.expired(member, time.Now())
+}
+
+// should be called with the lock
+func (store *stickyStore) save() {
+	now := time.Now()
+	for userId, member := range store.idToMember {
+		if store.expired(member, now) {
+			delete(store.idToMember, userId)
+		}
+	}
+
+	data, err := json.Marshal(store.idToMember)
+	if err == nil {
+		err = os.WriteFile(store.path, data, 0o644)
+	}
+	if err != nil {
+		log.Println("Fail to save sticky data :", err)
+	}
+}
+
+// restore the saved roles and nickname on a returning member, when they had a forbidden role
+// only the forbidden roles are restored (the prefix rules remove the other managed roles)
+func restoreSticky(s *discordgo.Session, sticky stickyMember, infos common.GuildAndConfInfo, member *discordgo.Member) int {
+	userId := member.User.ID
+	if userId == infos.OwnerId {
+		return 0
+	}
+
+	roleIds := sticky.RoleIds
+	if common.IdInSet(roleIds, infos.ForbiddenRoleIds) {
+		roleIds = slices.DeleteFunc(slices.Clone(roleIds), func(roleId string) bool {
+			_, ok := infos.ForbiddenRoleIds[roleId]
+			return !ok
+		})
+	}
+
+	return restoreRolesAndNick(s, sticky.Nick, roleIds, infos, member)
+}
+
+// add the saved roles and set the saved nickname (without prefix), then apply the prefix rules
+func restoreRolesAndNick(s *discordgo.Session, nick string, roleIds []string, infos common.GuildAndConfInfo, member *discordgo.Member) int {
+	userId := member.User.ID
+	counterError := 0
+	for _, roleId := range roleIds {
+		// ignore the roles deleted since the save
+		if _, ok := infos.RoleIdToDisplayName[roleId]; ok && !slices.Contains(member.Roles, roleId) {
+			if err := s.GuildMemberRoleAdd(infos.GuildId, userId, roleId); err != nil {
+				log.Println("Saved role addition failed :", err)
+				common.ApiErrors.Inc("role")
+				counterError++
+			}
+		}
+	}
+
+	// the prefix is added back by applyPrefix
+	if nick != "" && nick != cleanPrefixInNick(common.ExtractNick(member), infos.Prefixes) {
+		if err := s.GuildMemberNickname(infos.GuildId, userId, nick); err != nil {
+			log.Println("Nickname change failed (4) :", err)
+			common.ApiErrors.Inc("nickname")
+			counterError++
+		}
+	}
+
+	if member, err := s.GuildMember(infos.GuildId, userId); err == nil {
+		counterError += applyPrefix(s, nil, false, infos, member)
+	} else {
+		log.Println("Cannot retrieve member (3) :", err)
+		common.ApiErrors.Inc("member")
+		counterError++
+	}
+	return counterError
+}
@@ -0,0 +1,178 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+type suspendedMember struct {
+	Nick        string    `json:"nick"`
+	RoleIds     []string  `json:"roleIds"`
+	SuspendedAt time.Time `json:"suspendedAt"`
+}
+
+type suspensionModule struct {
+	baseModule
+	path string
+}
+
+func (m *suspensionModule) configure(b *bot) bool {
+	m.path = b.config.GetPath("SUSPENSION_PATH")
+	return m.path != ""
+}
+
+func (m *suspensionModule) register(b *bot) {
+	suspensions := makeSuspensionStore(b.config, m.path, b.cmdChannelSender())
+	b.onMemberUpdate(func(s *discordgo.Session, previous memberState, seen bool, member *discordgo.Member) bool {
+		// the roles are recorded before the removal by applyPrefix
+		infos := b.infosHolder.Get()
+		suspended, ok := suspensions.track(s, previous, seen, member, infos)
+		if ok {
+			b.memberQueue.Do(member.User.ID, func() {
+				restoreRolesAndNick(s, suspended.Nick, suspended.RoleIds, infos, member)
+			})
+		}
+		return ok
+	})
+}
+
+// suspensionStore record the managed roles and the nickname removed when a member get a forbidden role,
+// to give them back when the forbidden role is removed
+type suspensionStore struct {
+	path            string
+	timeoutDuration time.Duration
+	messageSender   chan<- common.MultipartMessage
+	suspendedMsg    string
+	liftedMsg       string
+	idToMember      map[string]suspendedMember
+	mutex           sync.Mutex
+}
+
+func makeSuspensionStore(config common.Config, path string, messageSender chan<- common.MultipartMessage) *suspensionStore {
+	store := &suspensionStore{
+		path: path, timeoutDuration: config.GetDurationSec("SUSPENSION_TIMEOUT"), messageSender: messageSender,
+		suspendedMsg: config.GetString("MESSAGE_SUSPENDED"), liftedMsg: config.GetString("MESSAGE_SUSPENSION_LIFTED"),
+		idToMember: map[string]suspendedMember{},
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Loading suspension data failed :", err)
+		}
+		return store
+	}
+
+	if err = json.Unmarshal(data, &store.idToMember); err != nil {
+		log.Println("Parsing suspension data failed :", err)
+	}
+	return store
+}
+
+// compare the member with its previous state, record the suspension when a forbidden role appear,
+// return the record when the forbidden roles disappear (ok is false when there is nothing to restore)
+func (store *suspensionStore) track(s *discordgo.Session, previous memberState, seen bool, member *discordgo.Member, infos common.GuildAndConfInfo) (suspendedMember, bool) {
+	if !seen || member.User.ID == infos.OwnerId || common.IdInSet(member.Roles, infos.IgnoredRoleIds) {
+		return suspendedMember{}, false
+	}
+
+	wasForbidden := common.IdInSet(previous.roleIds, infos.ForbiddenRoleIds)
+	isForbidden := common.IdInSet(member.Roles, infos.ForbiddenRoleIds)
+	switch {
+	case !wasForbidden && isForbidden:
+		store.suspend(s, previous, member, infos)
+	case wasForbidden && !isForbidden:
+		return store.lift(s, member, infos)
+	}
+	return suspendedMember{}, false
+}
+
+func (store *suspensionStore) suspend(s *discordgo.Session, previous memberState, member *discordgo.Member, infos common.GuildAndConfInfo) {
+	roleIds := []string{}
+	for _, roleId := range previous.roleIds {
+		if isManagedRole(roleId, infos) {
+			roleIds = append(roleIds, roleId)
+		}
+	}
+
+	userId := member.User.ID
+	store.mutex.Lock()
+	store.idToMember[userId] = suspendedMember{
+		Nick: cleanPrefixInNick(previous.nick, infos.Prefixes), RoleIds: roleIds, SuspendedAt: time.Now(),
+	}
+	store.save()
+	store.mutex.Unlock()
+
+	if store.timeoutDuration > 0 {
+		until := time.Now().Add(store.timeoutDuration)
+		if err := s.GuildMemberTimeout(infos.GuildId, userId, &until); err != nil {
+			log.Println("Suspension timeout failed :", err)
+		}
+	}
+	store.notify(store.suspendedMsg, member)
+}
+
+func (store *suspensionStore) lift(s *discordgo.Session, member *discordgo.Member, infos common.GuildAndConfInfo) (suspendedMember, bool) {
+	userId := member.User.ID
+	store.mutex.Lock()
+	suspended, ok := store.idToMember[userId]
+	if ok {
+		delete(store.idToMember, userId)
+		store.save()
+	}
+	store.mutex.Unlock()
+
+	if ok {
+		if store.timeoutDuration > 0 && member.CommunicationDisabledUntil != nil {
+			if err := s.GuildMemberTimeout(infos.GuildId, userId, nil); err != nil {
+				log.Println("Suspension timeout removing failed :", err)
+			}
+		}
+		store.notify(store.liftedMsg, member)
+	}
+	return suspended, ok
+}
+
+func (store *suspensionStore) notify(msg string, member *discordgo.Member) {
+	if store.messageSender != nil && msg != "" {
+		store.messageSender <- common.MultipartMessage{Message: strings.ReplaceAll(msg, common.UserPlaceHolder, common.ExtractNick(member))}
+	}
+}
+
+// should be called with the lock
+func (store *suspensionStore) save() {
+	data, err := json.Marshal(store.idToMember)
+	if err == nil {
+		err = os.WriteFile(store.path, data, 0o644)
+	}
+	if err != nil {
+		log.Println("Fail to save suspension data :", err)
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/dvaumoron/casiusbot/common"
@@ -31,13 +32,15 @@ type Translater interface {
 	Translate(msg string) string
 }
 
-func bgAddTranslationFilter(messageSender chan<- common.MultipartMessage, selector string, translater Translater) chan<- linkInfo {
+func bgAddTranslationFilter(messageSender chan<- common.MultipartMessage, selector string, translater Translater, workers *sync.WaitGroup) chan<- linkInfo {
 	filteringChan := make(chan linkInfo)
-	go addTranslationFiltering(messageSender, initExtracter(selector), translater, filteringChan)
+	workers.Add(1)
+	go addTranslationFiltering(messageSender, initExtracter(selector), translater, filteringChan, workers)
 	return filteringChan
 }
 
-func addTranslationFiltering(messageSender chan<- common.MultipartMessage, extracter func(linkInfo) string, translater Translater, filteringChan <-chan linkInfo) {
+func addTranslationFiltering(messageSender chan<- common.MultipartMessage, extracter func(linkInfo) string, translater Translater, filteringChan <-chan linkInfo, workers *sync.WaitGroup) {
+	defer workers.Done()
 	for info := range filteringChan {
 		messageSender <- common.MultipartMessage{
 			Message:    info.link,
@@ -0,0 +1,373 @@
+/*
+ *
+ * Copyright 2023 casiusbot authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/dvaumoron/casiusbot/common"
+)
+
+const (
+	whoisFileName = "whois.txt"
+
+	nameKindNick     = "nickname"
+	nameKindGlobal   = "global name"
+	nameKindUsername = "username"
+
+	datePlaceHolder = "{{date}}"
+)
+
+type nameChange struct {
+	Date time.Time `json:"date"`
+	Kind string    `json:"kind"`
+	Name string    `json:"name"`
+}
+
+type memberNames struct {
+	Nick       string       `json:"nick"`
+	GlobalName string       `json:"globalName"`
+	Username   string       `json:"username"`
+	Changes    []nameChange `json:"changes"`
+}
+
+// whoisMsgs are the configured lines of the whois (the last activity line is also used by the show activity menu)
+type whoisMsgs struct {
+	joinedMsg     string
+	rolesMsg      string
+	activityMsg   string
+	noActivityMsg string
+	namesMsg      string
+	actionsMsg    string
+}
+
+func makeWhoisMsgs(config common.Config) whoisMsgs {
+	return whoisMsgs{
+		joinedMsg: config.GetString("MESSAGE_WHOIS_JOINED"), rolesMsg: config.GetString("MESSAGE_WHOIS_ROLES"),
+		activityMsg: config.GetString("MESSAGE_WHOIS_ACTIVITY"), noActivityMsg: config.GetString("MESSAGE_WHOIS_NO_ACTIVITY"),
+		namesMsg: config.GetString("MESSAGE_WHOIS_NAMES"), actionsMsg: config.GetString("MESSAGE_WHOIS_ACTIONS"),
+	}
+}
+
+// whoisModule keep the name history (when HISTORY_PATH is set) and declare the whois command
+type whoisModule struct {
+	baseModule
+	msgs whoisMsgs
+}
+
+func (m *whoisModule) configure(b *bot) bool {
+	m.msgs = makeWhoisMsgs(b.config)
+	if historyPath := b.config.GetPath("HISTORY_PATH"); historyPath != "" {
+		b.history = makeNameHistory(historyPath)
+	}
+	return true
+}
+
+func (m *whoisModule) register(b *bot) {
+	if history := b.history; history != nil {
+		b.onMemberUpdate(func(s *discordgo.Session, previous memberState, seen bool, member *discordgo.Member) bool {
+			history.observe(member)
+			return false
+		})
+		b.onMemberAdd(func(s *discordgo.Session, member *discordgo.Member) {
+			history.observe(member)
+		})
+	}
+
+	b.addAdminCmd(helpGroupMembers, "WHOIS", []*discordgo.ApplicationCommandOption{{
+		Type: discordgo.ApplicationCommandOptionUser, Name: "user",
+		Description: b.config.GetString("PARAMETER_DESCRIPTION_WHOIS_CMD"), Required: true,
+	}}, func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		// the activity querier is nil without activity monitoring
+		whoisCmd(b.ctx, s, i, b.history, b.activityQuerier, m.msgs, b.dateFormat, b.infosHolder.Get())
+	})
+}
+
+func (m *whoisModule) start(b *bot) {
+	if b.history != nil {
+		go b.history.observeAll(b.session, b.guildId)
+	}
+}
+
+// nameHistory persist every nickname, global name and username seen for each member
+type nameHistory struct {
+	path      string
+	idToNames map[string]*memberNames
+	mutex     sync.Mutex
+}
+
+func makeNameHistory(path string) *nameHistory {
+	history := &nameHistory{path: path, idToNames: map[string]*memberNames{}}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Loading name history failed :", err)
+		}
+		return history
+	}
+
+	if err = json.Unmarshal(data, &history.idToNames); err != nil {
+		log.Println("Parsing name history failed :", err)
+	}
+	return history
+}
+
+func (h *nameHistory) observe(member *discordgo.Member) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.observeMember(member, time.Now()) {
+		h.save()
+	}
+}
+
+// record the names of all the guild members (done at startup to catch the changes during a downtime)
+func (h *nameHistory) observeAll(s *discordgo.Session, guildId string) {
+	guildMembers, err := s.GuildMembers(guildId, "", common.MemberCallLimit)
+	if err != nil {
+		log.Println("Cannot retrieve guild members (9) :", err)
+		return
+	}
+
+	now := time.Now()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	changed := false
+	for _, member := range guildMembers {
+		changed = h.observeMember(member, now) || changed
+	}
+	if changed {
+		h.save()
+	}
+}
+
+// should be called with the lock, return true when there is a change
+func (h *nameHistory) observeMember(member *discordgo.Member, now time.Time) bool {
+	user := member.User
+	names, ok := h.idToNames[user.ID]
+	if !ok {
+		names = &memberNames{}
+		h.idToNames[user.ID] = names
+	}
+
+	changed := false
+	for _, current := range [...]struct {
+		kind  string
+		last  *string
+		value string
+	}{
+		{kind: nameKindNick, last: &names.Nick, value: member.Nick},
+		{kind: nameKindGlobal, last: &names.GlobalName, value: user.GlobalName},
+		{kind: nameKindUsername, last: &names.Username, value: user.Username},
+	} {
+		if *current.last != current.value {
+			*current.last = current.value
+			names.Changes = append(names.Changes, nameChange{Date: now, Kind: current.kind, Name: current.value})
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (h *nameHistory) get(userId string) []nameChange {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if names, ok := h.idToNames[userId]; ok {
+		return append([]nameChange(nil), names.Changes...)
+	}
+	return nil
+}
+
+// should be called with the lock
+func (h *nameHistory) save() {
+	data, err := json.Marshal(h.idToNames)
+	if err == nil {
+		err = os.WriteFile(h.path, data, 0o644)
+	}
+	if err != nil {
+		log.Println("Fail to save name history :", err)
+	}
+}
+
+func whoisCmd(ctx context.Context, s *discordgo.Session, i *discordgo.InteractionCreate, history *nameHistory, activityQuerier chan<- activityQuery, msgs whoisMsgs, dateFormat string, infos common.GuildAndConfInfo) {
+	if !infos.Authorized(i) {
+		common.RespondCmd(s, i, infos, infos.Msgs.ErrUnauthorized)
+		return
+	}
+
+	common.DeferCmd(s, i, infos, func() *discordgo.WebhookEdit {
+		returnMsg := infos.Msgs.ErrGlobal
+		fileData := ""
+		if options := i.ApplicationCommandData().Options; len(options) != 0 {
+			if member, err := s.GuildMember(infos.GuildId, options[0].UserValue(nil).ID); err == nil {
+				returnMsg = describeUser(member.User)
+				fileData = whois(ctx, s, member, history, activityQuerier, msgs, dateFormat, infos)
+			} else {
+				log.Println("Cannot retrieve member (6) :", err)
+			}
+		}
+
+		edit := &discordgo.WebhookEdit{Content: &returnMsg}
+		if fileData != "" {
+			if len(returnMsg)+len(fileData) < messageLimit {
+				returnMsg += "\n" + fileData
+			} else {
+				edit.Files = []*discordgo.File{{Name: whoisFileName, Reader: strings.NewReader(fileData)}}
+			}
+		}
+		return edit
+	})
+}
+
+func whois(ctx context.Context, s *discordgo.Session, member *discordgo.Member, history *nameHistory, activityQuerier chan<- activityQuery, msgs whoisMsgs, dateFormat string, infos common.GuildAndConfInfo) string {
+	userId := member.User.ID
+	var buffer strings.Builder
+	buffer.WriteString(strings.ReplaceAll(msgs.joinedMsg, datePlaceHolder, member.JoinedAt.Format(dateFormat)))
+
+	buffer.WriteByte('\n')
+	buffer.WriteString(msgs.rolesMsg)
+	for _, roleId := range member.Roles {
+		if _, ok := infos.ForbiddenRoleIds[roleId]; ok || isManagedRole(roleId, infos) {
+			buffer.WriteByte(' ')
+			buffer.WriteString(roleName(roleId, infos))
+		}
+	}
+
+	if activityQuerier != nil {
+		if activityMsg, ok := lastActivity(ctx, activityQuerier, userId, msgs, dateFormat); ok {
+			buffer.WriteByte('\n')
+			buffer.WriteString(activityMsg)
+		}
+	}
+
+	if history != nil {
+		buffer.WriteByte('\n')
+		buffer.WriteString(msgs.namesMsg)
+		for _, change := range history.get(userId) {
+			buffer.WriteString("\n- ")
+			buffer.WriteString(change.Date.Format(dateFormat))
+			buffer.WriteByte(' ')
+			buffer.WriteString(change.Kind)
+			buffer.WriteString(" : ")
+			buffer.WriteString(change.Name)
+		}
+	}
+
+	buffer.WriteByte('\n')
+	buffer.WriteString(msgs.actionsMsg)
+	for _, action := range botActions(s, userId, dateFormat, infos) {
+		buffer.WriteString("\n- ")
+		buffer.WriteString(action)
+	}
+	return buffer.String()
+}
+
+// ok is false when the bot is ended before the response
+func lastActivity(ctx context.Context, activityQuerier chan<- activityQuery, userId string, msgs whoisMsgs, dateFormat string) (string, bool) {
+	response := make(chan activityData, 1)
+	var activity activityData
+	select {
+	case activityQuerier <- activityQuery{userId: userId, response: response}:
+		activity = <-response
+	case <-ctx.Done():
+		return "", false
+	}
+	last := activity.lastMessage
+	if last.Before(activity.lastVocal) {
+		last = activity.lastVocal
+	}
+
+	date := msgs.noActivityMsg
+	if !last.IsZero() {
+		date = last.Format(dateFormat)
+	}
+	msg := strings.ReplaceAll(msgs.activityMsg, datePlaceHolder, date)
+	return strings.ReplaceAll(msg, countPlaceHolder, strconv.Itoa(activity.messageCount)), true
+}
+
+// read the actions of the bot on the member from the guild audit log
+func botActions(s *discordgo.Session, userId string, dateFormat string, infos common.GuildAndConfInfo) []string {
+	auditLog, err := s.GuildAuditLog(infos.GuildId, s.State.User.ID, "", 0, 100)
+	if err != nil {
+		log.Println("Cannot retrieve the audit log (2) :", err)
+		return nil
+	}
+
+	var actions []string
+	for _, entry := range auditLog.AuditLogEntries {
+		if entry.TargetID == userId {
+			actions = append(actions, formatBotAction(entry, dateFormat))
+		}
+	}
+	return actions
+}
+
+func formatBotAction(entry *discordgo.AuditLogEntry, dateFormat string) string {
+	var buffer strings.Builder
+	if date, err := discordgo.SnowflakeTimestamp(entry.ID); err == nil {
+		buffer.WriteString(date.Format(dateFormat))
+	}
+	for _, change := range entry.Changes {
+		if change.Key == nil {
+			continue
+		}
+		switch *change.Key {
+		case discordgo.AuditLogChangeKeyNick:
+			buffer.WriteString(fmt.Sprintf(" nickname %v -> %v", valueOrEmpty(change.OldValue), valueOrEmpty(change.NewValue)))
+		case discordgo.AuditLogChangeKeyRoleAdd:
+			writeAuditRoles(&buffer, " +", change.NewValue)
+		case discordgo.AuditLogChangeKeyRoleRemove:
+			writeAuditRoles(&buffer, " -", change.NewValue)
+		}
+	}
+	if entry.Reason != "" {
+		buffer.WriteString(" (")
+		buffer.WriteString(entry.Reason)
+		buffer.WriteByte(')')
+	}
+	return buffer.String()
+}
+
+func writeAuditRoles(buffer *strings.Builder, sign string, value any) {
+	roles, _ := value.([]any)
+	for _, role := range roles {
+		if casted, ok := role.(map[string]any); ok {
+			name, _ := casted["name"].(string)
+			buffer.WriteString(sign)
+			buffer.WriteString(name)
+		}
+	}
+}
+
+func valueOrEmpty(value any) any {
+	if value == nil {
+		return "\"\""
+	}
+	return value
+}